@@ -27,10 +27,19 @@ export interface FullSyncEventData {
     message: string;
 }
 
+// Details the server records for this device and adds to the commits of its pushes
+export interface DeviceInfo {
+    name: string;
+    platform: string;
+    pluginVersion: string;
+}
+
 
 export class ApiClient {
     private baseUrl: string;
     private eventSource: EventSource | null = null;
+    private handledEvents: Promise<void> = Promise.resolve(); // events are handled one after another
+    private deviceInfo: DeviceInfo | null = null;
 
     constructor(baseUrl: string) {
         this.baseUrl = this.normalizeBaseUrl(baseUrl);
@@ -89,8 +98,23 @@ export class ApiClient {
         // This is already handled in settings tab: this.plugin.connectToEvents();
     }
 
+    setDeviceInfo(info: DeviceInfo) {
+        this.deviceInfo = info;
+    }
+
+    // Query string identifying the device: its ID plus the details in deviceInfo
+    private deviceQuery(deviceId: string): string {
+        const params = new URLSearchParams({ device_id: deviceId });
+        if (this.deviceInfo) {
+            if (this.deviceInfo.name) params.set('device_name', this.deviceInfo.name);
+            params.set('platform', this.deviceInfo.platform);
+            params.set('plugin_version', this.deviceInfo.pluginVersion);
+        }
+        return params.toString();
+    }
+
     async check(deviceId: string /*, currentHash: string // No longer needed */): Promise<CheckResponse> {
-        const response = await this.request(`/api/check?device_id=${deviceId}`); // current_hash parameter removed
+        const response = await this.request(`/api/check?${this.deviceQuery(deviceId)}`); // current_hash parameter removed
         if (!response.ok) {
             // Try to parse error from server if possible, otherwise generic error
             let errorMsg = `Server check failed with status ${response.status}`;
@@ -106,13 +130,13 @@ export class ApiClient {
     }
 
     async pull(deviceId: string): Promise<PullResponse> {
-        const response = await this.request(`/api/sync/pull?device_id=${deviceId}`);
+        const response = await this.request(`/api/sync/pull?${this.deviceQuery(deviceId)}`);
         if (!response.ok) throw new Error(`Pull failed with status ${response.status}`);
         return response.json();
     }
 
     async initialSync(deviceId: string, archive: Blob): Promise<SuccessResponse> {
-        const response = await this.request(`/api/sync/initial?device_id=${deviceId}`, {
+        const response = await this.request(`/api/sync/initial?${this.deviceQuery(deviceId)}`, {
             method: 'POST',
             headers: { 'Content-Type': 'application/gzip' },
             body: archive,
@@ -126,7 +150,7 @@ export class ApiClient {
             files_to_update: filesToUpdate,
             files_to_delete: filesToDelete,
         };
-        const response = await this.request(`/api/sync/push?device_id=${deviceId}`, {
+        const response = await this.request(`/api/sync/push?${this.deviceQuery(deviceId)}`, {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify(payload),
@@ -135,11 +159,19 @@ export class ApiClient {
         return response.json();
     }
 
+    async ack(deviceId: string, seq: string): Promise<SuccessResponse> {
+        const response = await this.request(`/api/events/ack?device_id=${deviceId}&seq=${encodeURIComponent(seq)}`, {
+            method: 'POST',
+        });
+        if (!response.ok) throw new Error(`Ack failed with status ${response.status}`);
+        return response.json();
+    }
+
     connectToEvents(
         deviceId: string,
-        onFileUpdated: (data: FileEventData) => void,
-        onFileDeleted: (data: FileEventData) => void,
-        onFullSyncRequired: (data: FullSyncEventData) => void
+        onFileUpdated: (data: FileEventData) => void | Promise<void>,
+        onFileDeleted: (data: FileEventData) => void | Promise<void>,
+        onFullSyncRequired: (data: FullSyncEventData) => void | Promise<void>
     ) {
         if (!this.baseUrl) {
             console.warn('[Yamanaka] Base URL not set. Cannot connect to SSE.');
@@ -151,11 +183,38 @@ export class ApiClient {
             return;
         }
 
-        const url = `${this.baseUrl}/api/events?device_id=${deviceId}`;
+        // acks=true keeps each event queued on the server until it is acknowledged
+        const url = `${this.baseUrl}/api/events?${this.deviceQuery(deviceId)}&acks=true`;
         console.log(`[Yamanaka] Attempting to connect to SSE at ${url}`);
         this.eventSource = new EventSource(url);
 
+        // An ack covers every earlier event, so events are handled in the order they arrive, one at a time,
+        // and each is acknowledged once its handler is done. After a failed handler, later events of the same
+        // connection are still applied but no longer acknowledged, so the server sends them again on reconnect.
+        let connection = 0;
+        let failedConnection = -1;
+        const handleInOrder = (event: MessageEvent, handle: () => void | Promise<void>) => {
+            const receivedOn = connection;
+            this.handledEvents = this.handledEvents.then(async () => {
+                try {
+                    await handle();
+                } catch (e) {
+                    failedConnection = receivedOn;
+                    console.error(`[Yamanaka] Could not apply event ${event.lastEventId}:`, e);
+                    return;
+                }
+                if (!event.lastEventId || failedConnection === receivedOn) return;
+                try {
+                    await this.ack(deviceId, event.lastEventId);
+                } catch (e) {
+                    // a later ack covers this event as well
+                    console.error(`[Yamanaka] Could not acknowledge event ${event.lastEventId}:`, e);
+                }
+            });
+        };
+
         this.eventSource.onopen = () => {
+            connection++;
             console.log('[Yamanaka] SSE connection established.');
             new Notice('Yamanaka: Real-time sync connected.');
         };
@@ -164,7 +223,7 @@ export class ApiClient {
             try {
                 const data = JSON.parse(event.data) as FileEventData;
                 console.log('[Yamanaka] SSE file_updated:', data);
-                onFileUpdated(data);
+                handleInOrder(event, () => onFileUpdated(data));
             } catch (e) {
                 console.error('[Yamanaka] Error parsing file_updated event data:', e, event.data);
             }
@@ -174,7 +233,7 @@ export class ApiClient {
             try {
                 const data = JSON.parse(event.data) as FileEventData;
                 console.log('[Yamanaka] SSE file_deleted:', data);
-                onFileDeleted(data);
+                handleInOrder(event, () => onFileDeleted(data));
             } catch (e) {
                 console.error('[Yamanaka] Error parsing file_deleted event data:', e, event.data);
             }
@@ -184,7 +243,7 @@ export class ApiClient {
             try {
                 const data = JSON.parse(event.data) as FullSyncEventData;
                 console.log('[Yamanaka] SSE full_sync_required:', data);
-                onFullSyncRequired(data);
+                handleInOrder(event, () => onFullSyncRequired(data));
             } catch (e) {
                 console.error('[Yamanaka] Error parsing full_sync_required event data:', e, event.data);
             }
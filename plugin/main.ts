@@ -1,4 +1,4 @@
-import { App, normalizePath, Notice, Plugin, TAbstractFile, TFile } from 'obsidian';
+import { App, normalizePath, Notice, Platform, Plugin, TAbstractFile, TFile } from 'obsidian';
 import { v4 as uuidv4 } from 'uuid';
 import { ApiClient } from './api/client';
 import { YamanakaSettingTab } from './settings/tab';
@@ -7,6 +7,7 @@ import { SyncManager } from './sync/manager';
 interface YamanakaPluginSettings {
 	serverUrl: string;
 	deviceId: string;
+    deviceName: string;
     // lastSyncHash: string; // Removed
     autoSync: boolean;
 }
@@ -14,6 +15,7 @@ interface YamanakaPluginSettings {
 const DEFAULT_SETTINGS: YamanakaPluginSettings = {
 	serverUrl: '',
 	deviceId: '',
+    deviceName: '',
     // lastSyncHash: '', // Removed
     autoSync: true,
 }
@@ -41,6 +43,7 @@ export default class YamanakaPlugin extends Plugin {
         }
 
         this.apiClient = new ApiClient(this.settings.serverUrl);
+        this.updateDeviceInfo();
         this.syncManager = new SyncManager(this);
 
 		this.settingsTab = new YamanakaSettingTab(this.app, this);
@@ -54,6 +57,15 @@ export default class YamanakaPlugin extends Plugin {
 		this.addPluginCommands();
 	}
 
+	// Tells the API client how to describe this device to the server
+	updateDeviceInfo() {
+		this.apiClient.setDeviceInfo({
+			name: this.settings.deviceName,
+			platform: platformName(),
+			pluginVersion: this.manifest.version,
+		});
+	}
+
 	addPluginCommands() {
 		this.addCommand({
 			id: 'yamanaka-manual-push',
@@ -257,3 +269,12 @@ export default class YamanakaPlugin extends Plugin {
 		await this.saveData(this.settings);
 	}
 }
+
+function platformName(): string {
+	if (Platform.isIosApp) return 'ios';
+	if (Platform.isAndroidApp) return 'android';
+	if (Platform.isMacOS) return 'macos';
+	if (Platform.isWin) return 'windows';
+	if (Platform.isLinux) return 'linux';
+	return Platform.isMobile ? 'mobile' : 'desktop';
+}
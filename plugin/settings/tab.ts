@@ -29,6 +29,18 @@ export class YamanakaSettingTab extends PluginSettingTab {
                     this.plugin.connectToEvents(); // Attempt to reconnect with new URL
 				}));
         
+        new Setting(containerEl)
+            .setName('Device Name')
+            .setDesc('Shown in the server\'s device list and as the author of this device\'s commits.')
+            .addText(text => text
+                .setPlaceholder('e.g., Work Laptop')
+                .setValue(this.plugin.settings.deviceName)
+                .onChange(async (value) => {
+                    this.plugin.settings.deviceName = value.trim();
+                    await this.plugin.saveSettings();
+                    this.plugin.updateDeviceInfo();
+                }));
+
         new Setting(containerEl)
             .setName('Automatic Sync')
             .setDesc('Automatically push and pull changes in the background.')
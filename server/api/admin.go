@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+type DevicesResponse struct {
+	Devices []state.DeviceInfo `json:"devices"`
+}
+
+// RequireAdmin only lets requests through that carry the admin token as "Authorization: Bearer <token>".
+// Without a configured token the admin API is disabled.
+func (h *ApiHandler) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.AdminToken == "" {
+			http.Error(w, "Admin API is disabled, set admin_token to enable it", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="yamanaka-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// DevicesHandler lists every tracked device with its connection state and pending backlog.
+func (h *ApiHandler) DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DevicesResponse{Devices: h.StateManager.Devices()})
+}
+
+// DeviceDisconnectHandler ends the live event stream of a device.
+func (h *ApiHandler) DeviceDisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := adminDeviceID(w, r)
+	if !ok {
+		return
+	}
+	if !h.StateManager.Disconnect(deviceID) {
+		http.Error(w, "Device is not connected", http.StatusNotFound)
+		return
+	}
+	log.Printf("Admin disconnected device %s", deviceID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Status: "disconnected"})
+}
+
+// DeviceBacklogClearHandler discards the missed events of a device and queues a full sync in their place,
+// so the device still catches up when it reconnects.
+func (h *ApiHandler) DeviceBacklogClearHandler(w http.ResponseWriter, r *http.Request) {
+	h.resetBacklog(w, r, true)
+}
+
+// DeviceBacklogDropHandler discards the missed events of a device without a replacement.
+func (h *ApiHandler) DeviceBacklogDropHandler(w http.ResponseWriter, r *http.Request) {
+	h.resetBacklog(w, r, false)
+}
+
+func (h *ApiHandler) resetBacklog(w http.ResponseWriter, r *http.Request, fullSync bool) {
+	deviceID, ok := adminDeviceID(w, r)
+	if !ok {
+		return
+	}
+	if !h.StateManager.HasDevice(deviceID) {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	if err := state.ClearMissedEvents(h.VaultPath, deviceID); err != nil {
+		log.Printf("WARN: resetBacklog: could not clear backlog of %s: %v", deviceID, err)
+		http.Error(w, fmt.Sprintf("Failed to clear backlog: %v", err), http.StatusInternalServerError)
+		return
+	}
+	status := "backlog dropped"
+	if fullSync {
+		state.StoreMissedEvent(h.VaultPath, deviceID, events.FullSyncEventData{
+			Message: "Your pending updates were cleared by an administrator. A full sync is required.",
+		})
+		status = "backlog cleared, full sync queued"
+	}
+	log.Printf("Admin reset backlog of device %s (full sync: %t)", deviceID, fullSync)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Status: status})
+}
+
+// DeviceRemoveHandler forgets a device: its stream is ended, its backlog dropped and it is no longer tracked.
+// A removed device that connects again is tracked anew.
+func (h *ApiHandler) DeviceRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := adminDeviceID(w, r)
+	if !ok {
+		return
+	}
+	found, err := h.StateManager.RemoveDevice(deviceID)
+	if !found {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("WARN: DeviceRemoveHandler: could not drop backlog of %s: %v", deviceID, err)
+		http.Error(w, fmt.Sprintf("Device removed but its backlog could not be dropped: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin removed device %s", deviceID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Status: "removed"})
+}
+
+// checks the method and returns the device_id of a device action
+func adminDeviceID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	deviceID := r.URL.Query().Get("device_id")
+	if !state.ValidDeviceID(deviceID) {
+		http.Error(w, "device_id is required and must be 1 to 64 letters, digits, '-' or '_'", http.StatusBadRequest)
+		return "", false
+	}
+	return deviceID, true
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"encoding/base64"
+	"log"
+
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// BroadcastChanges sends file events for changes that did not come from a client push
+// (upstream git, edits made directly on the server). Contents are read from the given revision.
+func (h *ApiHandler) BroadcastChanges(changes []vault.PathChange, rev string) {
+	for _, change := range changes {
+		if change.Action == vault.ChangeDeleted {
+			h.StateManager.Broadcast("", events.FileEventData{Path: change.Path})
+			continue
+		}
+		content, exists, err := vault.ReadFileAt(h.VaultPath, rev, change.Path)
+		if err != nil || !exists {
+			log.Printf("WARN: BroadcastChanges: Could not read %s at %s: %v. Skipping SSE broadcast for this file.", change.Path, rev, err)
+			continue
+		}
+		h.StateManager.Broadcast("", events.FileEventData{
+			Path:    change.Path,
+			Content: base64.StdEncoding.EncodeToString(content),
+		})
+	}
+}
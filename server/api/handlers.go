@@ -3,12 +3,18 @@ package api
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/metrics"
 	"github.com/tanq16/yamanaka/server/state"
 	"github.com/tanq16/yamanaka/server/vault"
 )
@@ -16,14 +22,34 @@ import (
 // ApiHandler holds dependencies for our handlers.
 type ApiHandler struct {
 	StateManager *state.Manager
+	Committer    *vault.Committer
+	Mirror       *vault.Mirror
+	Upstream     *vault.Upstream // nil when upstream sync is not configured
+	Maintenance  *vault.Maintenance
 	VaultPath    string
+
+	MissedEventsThreshold int           // reconnecting devices with more missed events get a full sync instead
+	HeartbeatInterval     time.Duration // interval of SSE heartbeat comments
+	MinFreeDisk           uint64        // readiness fails below this many free bytes
+	MaxCommitAge          time.Duration // readiness warns when the newest commit is older, zero disables it
+	AdminToken            string        // bearer token of the /api/admin endpoints, empty disables them
+	AllowedOrigin         string        // browser origin allowed to open /api/ws, "*" allows any
+	Draining              atomic.Bool   // set when the server shuts down, pushes on open WebSockets are refused from then on
+
+	webSockets sync.WaitGroup // open /api/ws sessions
 }
 
 // NewApiHandler creates a new ApiHandler with its dependencies.
-func NewApiHandler(sm *state.Manager, vaultPath string) *ApiHandler {
+func NewApiHandler(sm *state.Manager, committer *vault.Committer, mirror *vault.Mirror, vaultPath string) *ApiHandler {
 	return &ApiHandler{
 		StateManager: sm,
+		Committer:    committer,
+		Mirror:       mirror,
 		VaultPath:    vaultPath,
+
+		MissedEventsThreshold: 10,
+		HeartbeatInterval:     2 * time.Minute,
+		MinFreeDisk:           100 << 20,
 	}
 }
 
@@ -39,6 +65,12 @@ type SuccessResponse struct {
 	// NewHash string `json:"new_hash"` // Git hash is no longer immediately relevant to the client operation
 }
 
+type InitialSyncResponse struct {
+	Status   string `json:"status"`
+	Snapshot string `json:"snapshot,omitempty"`
+	Hash     string `json:"hash"`
+}
+
 type PullResponse struct {
 	// Hash  string      `json:"hash"` // Git hash is no longer the primary sync mechanism
 	Files []vault.File `json:"files"`
@@ -49,6 +81,21 @@ type PushRequest struct {
 	FilesToDelete []string     `json:"files_to_delete"`
 }
 
+// commitIdentity describes the device behind a request for git: the commit author and the metadata trailers.
+// Devices identify themselves with the device_name, platform and plugin_version query parameters.
+func commitIdentity(r *http.Request) (*vault.CommitAuthor, []vault.Trailer) {
+	query := r.URL.Query()
+	deviceID := query.Get("device_id")
+	author := vault.DeviceAuthor(deviceID, query.Get("device_name"))
+	trailers := []vault.Trailer{
+		{Key: "Device-Id", Value: deviceID},
+		{Key: "Device-Name", Value: query.Get("device_name")},
+		{Key: "Platform", Value: query.Get("platform")},
+		{Key: "Plugin-Version", Value: query.Get("plugin_version")},
+	}
+	return author, trailers
+}
+
 // --- Handlers ---
 
 // CheckHandler compares the client's hash with the server's latest git hash.
@@ -68,26 +115,39 @@ func (h *ApiHandler) CheckHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // InitialSyncHandler handles the first-time sync from a client, replacing the server's vault.
+// The previous state is kept as a snapshot and restored if the upload cannot be applied.
 func (h *ApiHandler) InitialSyncHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	deviceID := r.URL.Query().Get("device_id")
-
-	// 1. Clean the vault (delete all files except .git)
-	if err := vault.CleanDir(h.VaultPath); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to clean vault: %v", err), http.StatusInternalServerError)
+	// queued pushes are committed under their devices before the pre-sync snapshot takes the rest
+	h.Committer.Flush()
+	switch r.URL.Query().Get("mode") {
+	case "", "replace":
+	case "merge":
+		h.mergeInitialSync(w, r)
+		return
+	default:
+		http.Error(w, "mode must be replace or merge", http.StatusBadRequest)
 		return
 	}
 
-	// 2. Extract the uploaded tar.gz archive
-	if err := vault.ExtractTarGz(r.Body, h.VaultPath); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to extract archive: %v", err), http.StatusInternalServerError)
+	author, trailers := commitIdentity(r)
+	result, err := vault.ReplaceVault(h.VaultPath, r.Body, vault.WithTrailers("Initial sync", trailers...), author)
+	if errors.Is(err, vault.ErrInvalidArchive) {
+		http.Error(w, fmt.Sprintf("Failed to extract archive, vault left unchanged: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: InitialSyncHandler: Initial sync from %s failed: %v", deviceID, err)
+		http.Error(w, fmt.Sprintf("Failed to replace vault, previous state restored: %v", err), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("InitialSyncHandler: Vault replaced by %s with %d files (commit %s, previous state in snapshot %q).", deviceID, result.Files, result.Hash, result.Snapshot)
+	h.Mirror.Notify()
 
-	// 3. File operations successful. Git commit is handled by a periodic background job (and is irrelevant to this handler now).
 	// Notify other clients that a full sync might be required for them, as the entire vault state was replaced.
 	fullSyncMessage := fmt.Sprintf("Vault was reset and populated by an initial sync from device %s. Other clients should perform a full pull if they need the latest state.", deviceID)
 	h.StateManager.Broadcast(deviceID, events.FullSyncEventData{
@@ -96,8 +156,32 @@ func (h *ApiHandler) InitialSyncHandler(w http.ResponseWriter, r *http.Request)
 	})
 
 	// Respond to the initiating client.
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(SuccessResponse{Status: "success, initial sync processed. Other clients notified."})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InitialSyncResponse{
+		Status:   "success, initial sync processed. Other clients notified.",
+		Snapshot: result.Snapshot,
+		Hash:     result.Hash,
+	})
+}
+
+// turns a queued event into the SSE event to send
+// the content of an update is the file as it is now: any later change was queued as well and replaced it
+func (h *ApiHandler) missedEventData(missed state.MissedEvent) (string, any) {
+	switch missed.Action {
+	case state.MissedFullSync:
+		return events.SSEEventFullSyncRequired, events.FullSyncEventData{Message: missed.Message}
+	case state.MissedUpdate:
+		content, err := vault.ReadFile(h.VaultPath, missed.Path)
+		if err == nil {
+			return events.SSEEventFileUpdated, events.FileEventData{Path: missed.Path, Content: base64.StdEncoding.EncodeToString(content)}
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("WARN: Could not read %s for a missed event, requiring a full sync: %v", missed.Path, err)
+			return events.SSEEventFullSyncRequired, events.FullSyncEventData{Message: "A missed update could not be read. A full sync is required."}
+		}
+		// deleted without an event (e.g. by a rollback, which queues a full sync of its own)
+	}
+	return events.SSEEventFileDeleted, events.FileEventData{Path: missed.Path}
 }
 
 // PushHandler applies incremental changes from a client.
@@ -106,22 +190,50 @@ func (h *ApiHandler) PushHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	deviceID := r.URL.Query().Get("device_id")
+	defer metrics.PushDuration.Since(time.Now())
+	h.StateManager.Touch(r.URL.Query().Get("device_id"), r.RemoteAddr)
+	h.ackFromQuery(r)
 
 	var req PushRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		metrics.PushRequests.Inc("invalid")
 		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
+	if err := h.applyPush(r, req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid push, nothing was applied: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(SuccessResponse{Status: pushStatus})
+}
+
+const pushStatus = "success, push processed and changes broadcasted, commit queued"
+
+// writes and deletes the files of a push, broadcasts each change and queues the commit
+// the device and its commit identity come from the query of r
+// a path that escapes the vault or points into .git or a server directory rejects the whole push
+func (h *ApiHandler) applyPush(r *http.Request, req PushRequest) error {
+	deviceID := r.URL.Query().Get("device_id")
+	var changedPaths []string
+	if err := cleanPushPaths(&req); err != nil {
+		metrics.PushRequests.Inc("invalid")
+		log.Printf("WARN: PushHandler: Rejected push from %s: %v", deviceID, err)
+		return err
+	}
+
 	// 1. Process files to delete
 	for _, path := range req.FilesToDelete {
-		if err := vault.DeleteFile(h.VaultPath, path); err != nil {
+		if err := vault.DeleteFile(h.VaultPath, path, deviceID); err != nil {
 			log.Printf("WARN: PushHandler: Could not delete file %s: %v. Skipping SSE broadcast for this file.", path, err)
+			metrics.PushFiles.Inc("failed")
 			// Optionally, you could send an error event to the originating client, but not broadcast a delete.
 			continue
 		}
 		// Broadcast delete event
+		metrics.PushFiles.Inc("delete")
+		changedPaths = append(changedPaths, path)
 		log.Printf("PushHandler: File %s deleted by %s. Broadcasting.", path, deviceID)
 		h.StateManager.Broadcast(deviceID, events.FileEventData{
 			Path: path,
@@ -136,13 +248,18 @@ func (h *ApiHandler) PushHandler(w http.ResponseWriter, r *http.Request) {
 		contentBytes, err := base64.StdEncoding.DecodeString(file.Content)
 		if err != nil {
 			log.Printf("WARN: PushHandler: Could not decode file content for %s from device %s: %v. Skipping.", file.Path, deviceID, err)
+			metrics.PushFiles.Inc("failed")
 			continue
 		}
 		if err := vault.WriteFile(h.VaultPath, file.Path, contentBytes); err != nil {
 			log.Printf("WARN: PushHandler: Could not write file %s from device %s: %v. Skipping SSE broadcast for this file.", file.Path, deviceID, err)
+			metrics.PushFiles.Inc("failed")
 			continue
 		}
 		// Broadcast update/create event
+		metrics.PushFiles.Inc("update")
+		metrics.PushBytes.Add(float64(len(contentBytes)))
+		changedPaths = append(changedPaths, file.Path)
 		log.Printf("PushHandler: File %s updated/created by %s. Broadcasting.", file.Path, deviceID)
 		h.StateManager.Broadcast(deviceID, events.FileEventData{
 			Path:    file.Path,
@@ -151,31 +268,52 @@ func (h *ApiHandler) PushHandler(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	// 3. Respond to the client
-	// Commit changes to Git after processing all files and before responding to the client.
-	// This makes the backend changes persistent immediately.
-	commitMsg := fmt.Sprintf("Client push from device %s", deviceID)
-	_, err := vault.CommitChanges(h.VaultPath, commitMsg)
-	if err != nil {
-		// Log the error, but don't fail the entire push operation,
-		// as files are written and SSE events are broadcasted.
-		// The periodic commit will eventually pick up these changes if this one fails.
-		log.Printf("ERROR: PushHandler: Failed to commit changes for device %s: %v", deviceID, err)
-	} else {
-		log.Printf("PushHandler: Changes committed to Git for device %s.", deviceID)
+	// 3. Queue a commit
+	// The commit worker groups pushes arriving close together into one commit and
+	// announces the resulting hash with a commit_created event.
+	if len(changedPaths) > 0 {
+		author, trailers := commitIdentity(r)
+		h.Committer.Enqueue(vault.CommitRequest{
+			DeviceID: deviceID,
+			Author:   author,
+			Trailers: trailers,
+			Paths:    changedPaths,
+		})
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(SuccessResponse{Status: "success, push processed and changes broadcasted"})
+	metrics.PushRequests.Inc("ok")
+	return nil
+}
+
+// replaces the paths of a push by their cleaned form, the first invalid path is returned as error
+func cleanPushPaths(req *PushRequest) error {
+	for i, path := range req.FilesToDelete {
+		cleaned, err := vault.CleanRelPath(path)
+		if err != nil {
+			return err
+		}
+		req.FilesToDelete[i] = cleaned
+	}
+	for i, file := range req.FilesToUpdate {
+		cleaned, err := vault.CleanRelPath(file.Path)
+		if err != nil {
+			return err
+		}
+		req.FilesToUpdate[i].Path = cleaned
+	}
+	return nil
 }
 
 // PullHandler sends the entire current state of the vault to the client.
+// A pull with a device_id acknowledges every event queued for that device before the pull, the files sent cover them.
 func (h *ApiHandler) PullHandler(w http.ResponseWriter, r *http.Request) {
 	// currentHash, err := vault.GetCurrentHash(h.VaultPath) // Git hash is no longer sent
 	// if err != nil {
 	// 	http.Error(w, "Could not get server hash", http.StatusInternalServerError)
 	// 	return
 	// }
+	h.ackFromQuery(r)
+	coveredSeq := state.NextSeq()
 
 	files, err := vault.GetAllFiles(h.VaultPath) // This function reads directly from the filesystem
 	if err != nil {
@@ -184,10 +322,51 @@ func (h *ApiHandler) PullHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(PullResponse{
+	if err := json.NewEncoder(w).Encode(PullResponse{
 		// Hash:  currentHash, // Removed
 		Files: files,
-	})
+	}); err != nil {
+		return
+	}
+	if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+		h.StateManager.Ack(deviceID, coveredSeq)
+	}
+}
+
+// AckHandler records that a device received the events up to a sequence, the id of the SSE event.
+// Acknowledged events are removed from the device's queue, everything after them is sent again on reconnect.
+func (h *ApiHandler) AckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+	seq, err := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil || seq <= 0 {
+		http.Error(w, "seq must be a positive event id", http.StatusBadRequest)
+		return
+	}
+	h.StateManager.Ack(deviceID, seq)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Status: "acknowledged"})
+}
+
+// applies an ack piggybacked on a request as the ack query parameter
+func (h *ApiHandler) ackFromQuery(r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("device_id") == "" || query.Get("ack") == "" {
+		return
+	}
+	seq, err := strconv.ParseInt(query.Get("ack"), 10, 64)
+	if err != nil {
+		log.Printf("WARN: Ignoring invalid ack %q from %s", query.Get("ack"), query.Get("device_id"))
+		return
+	}
+	h.StateManager.Ack(query.Get("device_id"), seq)
 }
 
 // EventsHandler manages Server-Sent Events (SSE) for real-time updates.
@@ -197,158 +376,24 @@ func (h *ApiHandler) EventsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "device_id is required", http.StatusBadRequest)
 		return
 	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
 
 	// Set headers for SSE
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	// Create a channel for this client that can send various event types
-	eventChan := make(chan interface{})
-	h.StateManager.AddClient(deviceID, eventChan)
-	defer h.StateManager.RemoveClient(deviceID)
-
+	// the Last-Event-ID header of a reconnecting EventSource is not an ack: it names the last event received,
+	// which the client may not have applied yet
+	sub, autoAck := h.openSession(r, deviceID)
+	defer h.StateManager.RemoveClient(deviceID, sub)
 	log.Printf("Client %s connected for events", deviceID)
+	flusher.Flush() // the client sees the stream open before the first event
 
 	// Listen for context cancellation (client disconnects)
-	ctx := r.Context()
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
-		return
-	}
-
-	// Retrieve and send missed events
-	missedEvents := state.RetrieveAndClearMissedEvents(h.VaultPath, deviceID)
-	if len(missedEvents) > 10 { // Threshold for full sync
-		log.Printf("Client %s has %d missed events, requiring a full sync.", deviceID, len(missedEvents))
-		fullSyncEvent := events.FullSyncEventData{
-			Message: fmt.Sprintf("You have %d missed updates. A full sync is required.", len(missedEvents)),
-		}
-		jsonData, err := json.Marshal(fullSyncEvent)
-		if err != nil {
-			log.Printf("Error marshalling full sync event for %s: %v", deviceID, err)
-		} else {
-			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", events.SSEEventFullSyncRequired, string(jsonData))
-			flusher.Flush()
-		}
-	} else if len(missedEvents) > 0 {
-		log.Printf("Sending %d missed events to client %s", len(missedEvents), deviceID)
-		for _, eventMsg := range missedEvents {
-			var eventName string
-			var jsonData []byte
-			var err error
-
-			switch specificEvent := eventMsg.(type) {
-			case map[string]interface{}: // Unmarshalled from JSON
-				_, pathOk := specificEvent["path"].(string)
-				content, contentOk := specificEvent["content"].(string)
-
-				if pathOk {
-					if contentOk && content != "" {
-						eventName = events.SSEEventFileUpdated
-					} else {
-						eventName = events.SSEEventFileDeleted
-					}
-				} else if _, msgOk := specificEvent["message"]; msgOk {
-					eventName = events.SSEEventFullSyncRequired
-				}
-
-				jsonData, err = json.Marshal(specificEvent)
-
-			default:
-				log.Printf("Unknown type in missed events: %T", eventMsg)
-				continue
-			}
-
-			if err != nil {
-				log.Printf("Error marshalling missed event for %s: %v", deviceID, err)
-				continue
-			}
-			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventName, string(jsonData))
-		}
-		flusher.Flush()
-	}
-
-	// Heartbeat ticker
-	heartbeatTicker := time.NewTicker(2 * time.Minute)
-	defer heartbeatTicker.Stop()
-
-	for {
-		select {
-		case <-heartbeatTicker.C:
-			// Send a comment as a heartbeat
-			// SSE comments start with a colon and are ignored by EventSource implementations
-			// but they keep the connection alive.
-			fmt.Fprintf(w, ":heartbeat\n\n")
-			flusher.Flush()
-			log.Printf("Sent heartbeat to client %s", deviceID)
-		case eventMsg := <-eventChan:
-			var eventName string
-			var jsonData []byte
-			var err error
-
-			switch specificEvent := eventMsg.(type) {
-			case events.FileEventData:
-				if specificEvent.Content == "" { // Assume delete if content is empty, path is present
-					eventName = events.SSEEventFileDeleted
-				} else { // Assume create or update
-					// Could differentiate C/U based on prior existence, but client can usually infer or upsert.
-					// For now, let's use a generic "updated" for simplicity if content is present.
-					// Or, rely on client to know if file exists locally.
-					// To be more precise, PushHandler should ideally tell us if it was a create or update.
-					// For now, we'll use SSEEventFileUpdated if content is present.
-					// A better approach would be for PushHandler to send different event types.
-					// Let's assume PushHandler sends FileEventData for C/U/D and we determine type here.
-					// No, PushHandler will send FileEventData, and we determine eventName here based on content.
-					// Let's refine: PushHandler will set a temporary type field or we infer.
-					// For now: if content is present, it's an update/create. If not, it's a delete.
-					// The events.go defines SSEEventFileCreated, SSEEventFileUpdated, SSEEventFileDeleted.
-					// Let's assume the broadcaster (PushHandler) will send the correct specific event type
-					// or we enhance FileEventData to include an Action (Create, Update, Delete).
-
-					// Simpler: StateManager's Broadcast will receive specific event structs.
-					// Here, we just need to marshal what we receive.
-					// The event NAME (file_created, file_updated) needs to be determined.
-
-					// Let's assume for FileEventData, if Content is empty, it's a delete. Otherwise, update/create.
-					// This is a simplification. A more robust way is for the sender (PushHandler)
-					// to create specific event types (e.g. events.FileCreatedEventData, events.FileUpdatedEventData),
-					// but that requires more event types in events.go.
-					// Given current events.FileEventData, we infer.
-					if specificEvent.Content != "" {
-						eventName = events.SSEEventFileUpdated // Or created. Client plugin can upsert.
-					} else {
-						eventName = events.SSEEventFileDeleted
-					}
-					jsonData, err = json.Marshal(specificEvent)
-				}
-				// How PushHandler signals create vs update for FileEventData:
-				// Option 1: PushHandler sends different types (e.g. `events.FileCreatedData`, `events.FileUpdatedData`). Manager broadcasts `interface{}`. EventsHandler type switches.
-				// Option 2: FileEventData gets an `Action` field: "create", "update", "delete".
-				// For now, `PushHandler` creates `events.FileEventData`. If `Content` is present, it's `file_updated`. If `Content` is absent, it's `file_deleted`.
-				// This means "create" is also signaled as "file_updated". Client plugin handles this by creating if not exist, updating if exists.
-
-			case events.FullSyncEventData:
-				eventName = events.SSEEventFullSyncRequired
-				jsonData, err = json.Marshal(specificEvent)
-			default:
-				log.Printf("EventsHandler: Unknown event type received for device %s: %T", deviceID, eventMsg)
-				continue // Skip unknown event types
-			}
-
-			if err != nil {
-				log.Printf("EventsHandler: Error marshalling event data for device %s: %v", deviceID, err)
-				continue
-			}
-
-			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventName, string(jsonData))
-			flusher.Flush()
-
-		case <-ctx.Done():
-			// Client has disconnected
-			log.Printf("Client %s disconnected from event stream", deviceID)
-			return
-		}
-	}
+	h.streamEvents(r.Context(), deviceID, sub, autoAck, sseSink{w: w, flusher: flusher})
 }
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/state"
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// lockProbeTimeout is how long liveness waits for the vault lock before reporting a stuck server.
+const lockProbeTimeout = 10 * time.Second
+
+const (
+	HealthOK   = "ok"
+	HealthWarn = "warn" // reported, but the server stays ready
+	HealthFail = "fail"
+)
+
+// HealthCheck is the outcome of one check.
+type HealthCheck struct {
+	Status  string         `json:"status"`
+	Message string         `json:"message,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// LivenessHandler reports whether the process is able to serve, i.e. the vault lock is not stuck.
+func (h *ApiHandler) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeHealth(w, map[string]HealthCheck{"vault_lock": checkVaultLock()})
+}
+
+// ReadinessHandler checks everything a sync depends on and returns the result per check.
+// It answers 503 when any check fails, warnings keep it at 200.
+func (h *ApiHandler) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeHealth(w, map[string]HealthCheck{
+		"data_dir":      h.checkDataDir(),
+		"git":           h.checkGit(),
+		"last_commit":   h.checkLastCommit(),
+		"disk_space":    h.checkDiskSpace(),
+		"missed_events": h.checkMissedEvents(),
+	})
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]HealthCheck) {
+	response := HealthResponse{Status: HealthOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status == HealthFail {
+			response.Status = HealthFail
+			break
+		}
+		if check.Status == HealthWarn {
+			response.Status = HealthWarn
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status == HealthFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func checkVaultLock() HealthCheck {
+	acquired := make(chan struct{})
+	go func() {
+		state.FileSystemMutex.RLock()
+		state.FileSystemMutex.RUnlock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return HealthCheck{Status: HealthOK}
+	case <-time.After(lockProbeTimeout):
+		return HealthCheck{Status: HealthFail, Message: fmt.Sprintf("vault lock not available within %s", lockProbeTimeout)}
+	}
+}
+
+func (h *ApiHandler) checkDataDir() HealthCheck {
+	if err := vault.CheckWritable(h.VaultPath); err != nil {
+		return HealthCheck{Status: HealthFail, Message: fmt.Sprintf("data directory is not writable: %v", err)}
+	}
+	return HealthCheck{Status: HealthOK}
+}
+
+func (h *ApiHandler) checkGit() HealthCheck {
+	head, err := vault.CheckRepo(h.VaultPath)
+	if err != nil {
+		return HealthCheck{Status: HealthFail, Message: fmt.Sprintf("git repository is not readable: %v", err)}
+	}
+	if head.Hash == "" {
+		return HealthCheck{Status: HealthOK, Message: "no commits yet"}
+	}
+	return HealthCheck{Status: HealthOK, Details: map[string]any{"head": head.Hash}}
+}
+
+// fails when the latest commit attempt failed, warns when the newest commit is older than MaxCommitAge
+func (h *ApiHandler) checkLastCommit() HealthCheck {
+	commitStatus := vault.LastCommitStatus()
+	check := HealthCheck{Status: HealthOK, Details: map[string]any{}}
+	if !commitStatus.LastAttempt.IsZero() {
+		check.Details["last_attempt"] = commitStatus.LastAttempt
+	}
+	if commitStatus.LastError != "" {
+		check.Status = HealthFail
+		check.Message = "last commit failed: " + commitStatus.LastError
+	}
+	head, err := vault.CheckRepo(h.VaultPath)
+	if err != nil || head.Hash == "" {
+		return check
+	}
+	age := time.Since(head.When)
+	check.Details["hash"] = head.Hash
+	check.Details["when"] = head.When.UTC()
+	check.Details["age_seconds"] = int64(age.Seconds())
+	if check.Status == HealthOK && h.MaxCommitAge > 0 && age > h.MaxCommitAge {
+		check.Status = HealthWarn
+		check.Message = fmt.Sprintf("newest commit is older than %s", h.MaxCommitAge)
+	}
+	return check
+}
+
+func (h *ApiHandler) checkDiskSpace() HealthCheck {
+	free, err := vault.FreeDiskSpace(h.VaultPath)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return HealthCheck{Status: HealthOK, Message: "free space is not reported on this platform"}
+	}
+	if err != nil {
+		return HealthCheck{Status: HealthFail, Message: fmt.Sprintf("could not read free space: %v", err)}
+	}
+	check := HealthCheck{Status: HealthOK, Details: map[string]any{"free_bytes": free, "min_free_bytes": h.MinFreeDisk}}
+	if free < h.MinFreeDisk {
+		check.Status = HealthFail
+		check.Message = "free disk space is below the minimum"
+	}
+	return check
+}
+
+func (h *ApiHandler) checkMissedEvents() HealthCheck {
+	if err := state.CheckMissedEventsStore(h.VaultPath); err != nil {
+		return HealthCheck{Status: HealthFail, Message: fmt.Sprintf("missed events store is not writable: %v", err)}
+	}
+	counts := state.MissedEventCounts(h.VaultPath)
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return HealthCheck{Status: HealthOK, Details: map[string]any{"devices_with_backlog": len(counts), "queued_events": total}}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/state"
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// an ApiHandler on a fresh vault with one commit
+func newTestHandler(t *testing.T) *ApiHandler {
+	t.Helper()
+	vaultPath := t.TempDir()
+	if err := vault.InitRepo(vaultPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := vault.WriteFile(vaultPath, "a.md", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vault.CommitPathsAs(vaultPath, []string{"a.md"}, "first", nil); err != nil {
+		t.Fatal(err)
+	}
+	committer := vault.NewCommitter(vaultPath, time.Hour, time.Hour, nil)
+	return NewApiHandler(state.NewManager(vaultPath), committer, vault.NewMirror(vaultPath, nil), vaultPath)
+}
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, HealthResponse) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var response HealthResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("decode health response: %v", err)
+	}
+	return recorder.Code, response
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		prepare    func(h *ApiHandler)
+		wantCode   int
+		wantStatus string
+		wantCheck  string // the check that is not ok
+	}{
+		{"ready", func(h *ApiHandler) {}, http.StatusOK, HealthOK, ""},
+		{"old commit", func(h *ApiHandler) { h.MaxCommitAge = time.Nanosecond }, http.StatusOK, HealthWarn, "last_commit"},
+		{"disk full", func(h *ApiHandler) { h.MinFreeDisk = 1 << 62 }, http.StatusServiceUnavailable, HealthFail, "disk_space"},
+		{"no repository", func(h *ApiHandler) {
+			if err := os.RemoveAll(filepath.Join(h.VaultPath, ".git")); err != nil {
+				t.Fatal(err)
+			}
+		}, http.StatusServiceUnavailable, HealthFail, "git"},
+		{"failed commit", func(h *ApiHandler) {
+			if _, err := vault.CommitPathsAs(t.TempDir(), []string{"a.md"}, "fails, not a repository", nil); err == nil {
+				t.Fatal("commit outside a repository succeeded")
+			}
+		}, http.StatusServiceUnavailable, HealthFail, "last_commit"},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t) // its commit also clears a failed commit of an earlier case
+		tt.prepare(h)
+		code, response := getHealth(t, h.ReadinessHandler)
+		if code != tt.wantCode || response.Status != tt.wantStatus {
+			t.Errorf("%s: %d %s, want %d %s: %+v", tt.name, code, response.Status, tt.wantCode, tt.wantStatus, response.Checks)
+		}
+		for _, name := range []string{"data_dir", "git", "last_commit", "disk_space", "missed_events"} {
+			check, ok := response.Checks[name]
+			if !ok {
+				t.Errorf("%s: check %s missing", tt.name, name)
+			}
+			if wantOK := name != tt.wantCheck; (check.Status == HealthOK) != wantOK {
+				t.Errorf("%s: check %s = %+v", tt.name, name, check)
+			}
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	newTestHandler(t).ReadinessHandler(recorder, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /readyz = %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	code, response := getHealth(t, newTestHandler(t).LivenessHandler)
+	if code != http.StatusOK || response.Checks["vault_lock"].Status != HealthOK {
+		t.Errorf("liveness = %d %+v, want ok", code, response)
+	}
+}
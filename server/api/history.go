@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// DiffHandler returns the diff of a single file between two revisions.
+// Text files get a unified diff plus structured hunks, binary files a size/hash summary.
+func (h *ApiHandler) DiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	path := query.Get("path")
+	from := query.Get("from")
+	to := query.Get("to")
+	if path == "" || from == "" {
+		http.Error(w, "path and from are required", http.StatusBadRequest)
+		return
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+
+	diff, err := vault.DiffFile(h.VaultPath, from, to, path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not diff file: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+type RollbackResponse struct {
+	Status  string `json:"status"`
+	Target  string `json:"target"`
+	NewHash string `json:"new_hash"`
+}
+
+// RollbackHandler restores the whole vault to a commit or a point in time.
+// The rollback is recorded as a new commit and every device is told to do a full sync.
+func (h *ApiHandler) RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	commit := query.Get("commit")
+	timestamp := query.Get("timestamp")
+	if (commit == "") == (timestamp == "") {
+		http.Error(w, "exactly one of commit or timestamp is required", http.StatusBadRequest)
+		return
+	}
+
+	var target string
+	var err error
+	if commit != "" {
+		target, err = vault.ResolveRevision(h.VaultPath, commit)
+	} else {
+		var at time.Time
+		at, err = time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid timestamp (expected RFC3339): %v", err), http.StatusBadRequest)
+			return
+		}
+		target, err = vault.RevisionAt(h.VaultPath, at)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not resolve rollback target: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h.rollbackTo(w, r, target, target)
+}
+
+// restores the vault to target, tells every device to do a full sync and writes the response
+// label names the target in the commit message and the event (a hash or a snapshot)
+func (h *ApiHandler) rollbackTo(w http.ResponseWriter, r *http.Request, target, label string) {
+	deviceID := r.URL.Query().Get("device_id")
+	author, trailers := commitIdentity(r)
+	commitMsg := fmt.Sprintf("Rollback to %s", label)
+	// queued pushes get their own commits first, the pre-rollback commit would otherwise take them over
+	h.Committer.Flush()
+	newHash, err := vault.Rollback(h.VaultPath, target, vault.WithTrailers(commitMsg, trailers...), author)
+	if err != nil {
+		log.Printf("ERROR: RollbackHandler: Rollback to %s failed: %v", label, err)
+		http.Error(w, fmt.Sprintf("Rollback failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("RollbackHandler: Vault rolled back to %s by %s (commit %s).", label, deviceID, newHash)
+
+	// Every device, including the requester, now holds files newer than the vault.
+	h.StateManager.Broadcast("", events.FullSyncEventData{
+		Message: fmt.Sprintf("Vault was rolled back to %s by device %s. A full sync is required.", label, deviceID),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RollbackResponse{Status: "success, vault rolled back", Target: target, NewHash: newHash})
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// MaintenanceHandler compacts the history and runs gc right away.
+// With dry_run=true it only reports how many commits would remain and the largest blobs.
+func (h *ApiHandler) MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := h.Maintenance.Run(dryRun)
+	if err != nil {
+		log.Printf("WARN: MaintenanceHandler: maintenance failed: %v", err)
+		http.Error(w, fmt.Sprintf("Maintenance failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
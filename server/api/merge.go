@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// mergeInitialSync handles /api/sync/initial?mode=merge: the client's files are merged into the vault
+// instead of replacing it, files that differ are resolved with the conflict query parameter.
+func (h *ApiHandler) mergeInitialSync(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceID := query.Get("device_id")
+	policy, err := vault.ParseConflictPolicy(query.Get("conflict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	label := query.Get("device_name")
+	if label == "" {
+		label = deviceID
+	}
+	if label == "" {
+		label = "initial sync"
+	}
+
+	author, trailers := commitIdentity(r)
+	message := vault.WithTrailers("Merge initial sync", append(trailers, vault.Trailer{Key: "Conflict-Policy", Value: string(policy)})...)
+	result, err := vault.MergeVault(h.VaultPath, r.Body, policy, label, message, author)
+	if errors.Is(err, vault.ErrInvalidArchive) {
+		http.Error(w, fmt.Sprintf("Failed to extract archive, vault left unchanged: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: InitialSyncHandler: Merge from %s failed: %v", deviceID, err)
+		http.Error(w, fmt.Sprintf("Failed to merge vault, changes reverted: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("InitialSyncHandler: Vault merged with %s, %d files changed (commit %s).", deviceID, len(result.Changes), result.Hash)
+	if len(result.Changes) > 0 {
+		h.Mirror.Notify()
+		h.BroadcastChanges(result.Changes, result.Hash)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+type MirrorStatusResponse struct {
+	Remotes []vault.MirrorStatus `json:"remotes"`
+}
+
+// MirrorStatusHandler reports the last push attempt and last successful push of every mirror remote.
+func (h *ApiHandler) MirrorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MirrorStatusResponse{Remotes: h.Mirror.Status()})
+}
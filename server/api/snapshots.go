@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+type SnapshotListResponse struct {
+	Snapshots []vault.Snapshot `json:"snapshots"`
+}
+
+// SnapshotsHandler lists snapshots (GET) or tags the current vault state as a new one (POST ?name=&note=).
+func (h *ApiHandler) SnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		snapshots, err := vault.ListSnapshots(h.VaultPath)
+		if err != nil {
+			http.Error(w, "Could not list snapshots", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SnapshotListResponse{Snapshots: snapshots})
+	case http.MethodPost:
+		query := r.URL.Query()
+		tagger, _ := commitIdentity(r)
+		// queued pushes are committed under their devices, not by the snapshot
+		h.Committer.Flush()
+		snapshot, err := vault.CreateSnapshot(h.VaultPath, query.Get("name"), query.Get("note"), tagger)
+		if errors.Is(err, vault.ErrSnapshotExists) {
+			http.Error(w, "A snapshot with this name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("WARN: SnapshotsHandler: Could not create snapshot %q: %v", query.Get("name"), err)
+			http.Error(w, fmt.Sprintf("Could not create snapshot: %v", err), http.StatusBadRequest)
+			return
+		}
+		log.Printf("SnapshotsHandler: Snapshot %s created at %s by %s.", snapshot.Name, snapshot.Hash, query.Get("device_id"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SnapshotDeleteHandler removes a snapshot; its commits stay in the history.
+func (h *ApiHandler) SnapshotDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if err := vault.DeleteSnapshot(h.VaultPath, name); err != nil {
+		if errors.Is(err, vault.ErrSnapshotNotFound) {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not delete snapshot: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Status: "success, snapshot deleted"})
+}
+
+// SnapshotDownloadHandler streams the files of a snapshot as a .tar.gz archive.
+func (h *ApiHandler) SnapshotDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if _, err := vault.ResolveSnapshot(h.VaultPath, name); err != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+	if err := vault.WriteSnapshotArchive(h.VaultPath, name, w); err != nil {
+		// headers are already sent, the client sees a truncated archive
+		log.Printf("ERROR: SnapshotDownloadHandler: Archive of %s failed: %v", name, err)
+	}
+}
+
+// SnapshotRestoreHandler rolls the whole vault back to a snapshot, like RollbackHandler.
+func (h *ApiHandler) SnapshotRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	target, err := vault.ResolveSnapshot(h.VaultPath, name)
+	if err != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	h.rollbackTo(w, r, target, "snapshot "+name)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/metrics"
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+// eventSink is the transport of an event stream, an SSE response or a WebSocket connection.
+type eventSink interface {
+	// writes one event, seq is zero for events that are not acknowledged
+	send(seq int64, eventName string, data any) error
+	heartbeat() error
+	// tells the client why the server ended the stream, final is nil when there is nothing to say
+	end(final any)
+}
+
+// registers the event stream of a device and reports whether its events count as acknowledged once written
+// Events count as acknowledged once written, so clients that never ack keep working. A client that connects
+// with acks=true keeps them queued until it acknowledges them and gets them again after a reconnect.
+func (h *ApiHandler) openSession(r *http.Request, deviceID string) (*state.Subscription, bool) {
+	query := r.URL.Query()
+	h.ackFromQuery(r)
+	autoAck := true
+	if acks, err := strconv.ParseBool(query.Get("acks")); err == nil && acks {
+		autoAck = false
+	}
+	// the state manager fills the bounded event queue of the session
+	sub := h.StateManager.AddClient(deviceID, r.RemoteAddr, state.DeviceMetadata{
+		Name:          query.Get("device_name"),
+		Platform:      query.Get("platform"),
+		PluginVersion: query.Get("plugin_version"),
+	})
+	return sub, autoAck
+}
+
+// sends a device the events still queued for it, they stay queued until acknowledged,
+// then everything broadcast to it until ctx is done, the sink fails or the server ends the session
+func (h *ApiHandler) streamEvents(ctx context.Context, deviceID string, sub *state.Subscription, autoAck bool, sink eventSink) {
+	missedEvents := state.PendingMissedEvents(h.VaultPath, deviceID)
+	sent := make(map[int64]bool, len(missedEvents)) // queued after connecting, these also come through the subscription
+	var lastSent int64
+	if len(missedEvents) > h.MissedEventsThreshold {
+		log.Printf("Client %s has %d missed events, requiring a full sync.", deviceID, len(missedEvents))
+		fullSyncEvent := events.FullSyncEventData{
+			Message: fmt.Sprintf("You have %d missed updates. A full sync is required.", len(missedEvents)),
+		}
+		seq := state.StoreMissedEvent(h.VaultPath, deviceID, fullSyncEvent)
+		if err := sendEvent(sink, seq, events.SSEEventFullSyncRequired, fullSyncEvent); err != nil {
+			return
+		}
+		lastSent = seq
+	} else if len(missedEvents) > 0 {
+		log.Printf("Sending %d missed events to client %s", len(missedEvents), deviceID)
+		for _, missed := range missedEvents {
+			eventName, eventData := h.missedEventData(missed)
+			if err := sendEvent(sink, missed.Seq, eventName, eventData); err != nil {
+				return
+			}
+			sent[missed.Seq] = true
+			lastSent = missed.Seq
+		}
+	}
+	if autoAck && lastSent > 0 {
+		h.StateManager.Ack(deviceID, lastSent)
+	}
+
+	// Heartbeat ticker
+	heartbeatTicker := time.NewTicker(h.HeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case <-heartbeatTicker.C:
+			if err := sink.heartbeat(); err != nil {
+				return
+			}
+			log.Printf("Sent heartbeat to client %s", deviceID)
+		case <-sub.Done():
+			// the session was ended by the server
+			sink.end(sub.Final())
+			log.Printf("Ended event stream of client %s", deviceID)
+			return
+		case eventMsg := <-sub.Events():
+			var seq int64
+			if sequenced, ok := eventMsg.(state.Sequenced); ok {
+				if sent[sequenced.Seq] {
+					continue
+				}
+				seq, eventMsg = sequenced.Seq, sequenced.Event
+			}
+			eventName, ok := liveEventName(eventMsg)
+			if !ok {
+				log.Printf("EventsHandler: Unknown event type received for device %s: %T", deviceID, eventMsg)
+				continue // Skip unknown event types
+			}
+			if err := sendEvent(sink, seq, eventName, eventMsg); err != nil {
+				return
+			}
+			if autoAck && seq > 0 {
+				h.StateManager.Ack(deviceID, seq)
+			}
+		case <-ctx.Done():
+			// Client has disconnected
+			log.Printf("Client %s disconnected from event stream", deviceID)
+			return
+		}
+	}
+}
+
+func sendEvent(sink eventSink, seq int64, eventName string, data any) error {
+	if err := sink.send(seq, eventName, data); err != nil {
+		return err
+	}
+	metrics.EventsSent.Inc(eventName)
+	return nil
+}
+
+// the stream event name of a broadcast event
+func liveEventName(event any) (string, bool) {
+	switch specificEvent := event.(type) {
+	case events.FileEventData:
+		// content is empty for a delete; creates and updates are both file_updated, the client upserts
+		if specificEvent.Content == "" {
+			return events.SSEEventFileDeleted, true
+		}
+		return events.SSEEventFileUpdated, true
+	case events.FullSyncEventData:
+		return events.SSEEventFullSyncRequired, true
+	case events.CommitEventData:
+		return events.SSEEventCommitCreated, true
+	}
+	return "", false
+}
+
+// sseSink writes events as Server-Sent Events.
+type sseSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// writes one SSE event, with an id when the event is queued and has to be acknowledged
+func (s sseSink) send(seq int64, eventName string, data any) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if seq > 0 {
+		fmt.Fprintf(s.w, "id: %d\n", seq)
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", eventName, string(jsonData)); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Send a comment as a heartbeat
+// SSE comments start with a colon and are ignored by EventSource implementations
+// but they keep the connection alive.
+func (s sseSink) heartbeat() error {
+	if _, err := fmt.Fprintf(s.w, ":heartbeat\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s sseSink) end(final any) {
+	switch event := final.(type) {
+	case events.ServerShutdownEventData:
+		// the retry field tells EventSource how long to wait before reconnecting
+		fmt.Fprintf(s.w, "retry: %d\n", event.RetryAfter*1000)
+		sendEvent(s, 0, events.SSEEventServerShutdown, event)
+	case events.DisconnectedEventData:
+		sendEvent(s, 0, events.SSEEventDisconnected, event)
+	}
+}
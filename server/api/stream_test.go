@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// serves the event stream and sync endpoints of h
+func newTestServer(t *testing.T, h *ApiHandler) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/events", h.EventsHandler)
+	mux.HandleFunc("/api/events/ack", h.AckHandler)
+	mux.HandleFunc("/api/ws", h.WebSocketHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+type sseEvent struct {
+	id   string
+	name string
+	data string
+}
+
+// testStream is an open /api/events stream of one device.
+type testStream struct {
+	t      *testing.T
+	h      *ApiHandler
+	device string
+	cancel context.CancelFunc
+	events chan sseEvent
+}
+
+// opens the event stream with the given query and waits until the server registered it
+func openTestStream(t *testing.T, h *ApiHandler, server *httptest.Server, query string, header http.Header) *testStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		cancel()
+		t.Fatalf("open event stream: %v", err)
+	}
+	s := &testStream{t: t, h: h, cancel: cancel, events: make(chan sseEvent, 16)}
+	s.device = request.URL.Query().Get("device_id")
+	go func() {
+		defer response.Body.Close()
+		scanner := bufio.NewScanner(response.Body)
+		var event sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.name != "" {
+					s.events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		close(s.events)
+	}()
+	waitFor(t, "the stream to be registered", func() bool { return h.StateManager.IsClientActive(s.device) })
+	return s
+}
+
+func (s *testStream) next() sseEvent {
+	s.t.Helper()
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			s.t.Fatal("event stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no event within 5s")
+	}
+	return sseEvent{}
+}
+
+// closes the stream like a client that went away and waits until the server noticed
+func (s *testStream) close() {
+	s.cancel()
+	waitFor(s.t, "the stream to end", func() bool { return !s.h.StateManager.IsClientActive(s.device) })
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// writes a file to the vault and broadcasts it as a change of another device
+func broadcastUpdate(t *testing.T, h *ApiHandler, relPath string) {
+	t.Helper()
+	if err := vault.WriteFile(h.VaultPath, relPath, []byte(relPath)); err != nil {
+		t.Fatal(err)
+	}
+	h.StateManager.Broadcast("phone", events.FileEventData{Path: relPath, Content: base64.StdEncoding.EncodeToString([]byte(relPath))})
+}
+
+func eventPath(t *testing.T, event sseEvent) string {
+	t.Helper()
+	var data events.FileEventData
+	if err := json.Unmarshal([]byte(event.data), &data); err != nil {
+		t.Fatalf("event %+v: %v", event, err)
+	}
+	return data.Path
+}
+
+func TestUnacknowledgedEventsAreSentAgain(t *testing.T) {
+	h := newTestHandler(t)
+	server := newTestServer(t, h)
+
+	stream := openTestStream(t, h, server, "device_id=laptop&acks=true", nil)
+	broadcastUpdate(t, h, "a.md")
+	first := stream.next()
+	if first.name != events.SSEEventFileUpdated || first.id == "" || eventPath(t, first) != "a.md" {
+		t.Fatalf("first event = %+v, want an update of a.md with an id", first)
+	}
+	stream.close()
+
+	// Last-Event-ID only says the event was received, it is sent again until it is acknowledged
+	stream = openTestStream(t, h, server, "device_id=laptop&acks=true", http.Header{"Last-Event-ID": {first.id}})
+	if again := stream.next(); again.id != first.id || eventPath(t, again) != "a.md" {
+		t.Fatalf("after reconnecting = %+v, want %+v again", again, first)
+	}
+	response, err := http.Post(server.URL+"/api/events/ack?device_id=laptop&seq="+first.id, "", nil)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("ack: %v %v", response, err)
+	}
+	response.Body.Close()
+	stream.close()
+
+	stream = openTestStream(t, h, server, "device_id=laptop&acks=true", nil)
+	broadcastUpdate(t, h, "b.md")
+	if event := stream.next(); eventPath(t, event) != "b.md" {
+		t.Errorf("after the ack = %+v, want only the new update of b.md", event)
+	}
+	stream.close()
+
+	// without acks=true an event counts as acknowledged once it is written
+	stream = openTestStream(t, h, server, "device_id=laptop", nil)
+	if event := stream.next(); eventPath(t, event) != "b.md" {
+		t.Errorf("first event = %+v, want the unacknowledged update of b.md", event)
+	}
+	broadcastUpdate(t, h, "c.md")
+	if event := stream.next(); eventPath(t, event) != "c.md" {
+		t.Errorf("live event = %+v, want the update of c.md", event)
+	}
+	stream.close()
+	stream = openTestStream(t, h, server, "device_id=laptop", nil)
+	broadcastUpdate(t, h, "d.md")
+	if event := stream.next(); eventPath(t, event) != "d.md" {
+		t.Errorf("after reconnecting = %+v, want only the new update of d.md", event)
+	}
+	stream.close()
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+type TrashListResponse struct {
+	Entries []vault.TrashEntry `json:"entries"`
+}
+
+type TrashPurgeResponse struct {
+	Status string `json:"status"`
+	Purged int    `json:"purged"`
+}
+
+// TrashListHandler lists recently deleted files, newest first.
+func (h *ApiHandler) TrashListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entries, err := vault.ListTrash(h.VaultPath)
+	if err != nil {
+		http.Error(w, "Could not read trash", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TrashListResponse{Entries: entries})
+}
+
+// TrashRestoreHandler moves a trashed file back to its original path and broadcasts it to all devices.
+func (h *ApiHandler) TrashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceID := r.URL.Query().Get("device_id")
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	entry, content, err := vault.RestoreFromTrash(h.VaultPath, id)
+	if errors.Is(err, vault.ErrRestoreConflict) {
+		http.Error(w, fmt.Sprintf("Could not restore %s: %v", entry.Path, err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not restore trash entry %s: %v", id, err), http.StatusNotFound)
+		return
+	}
+	log.Printf("TrashRestoreHandler: File %s restored from trash by %s. Broadcasting.", entry.Path, deviceID)
+	// The requester does not have the file either, so nobody is skipped.
+	h.StateManager.Broadcast("", events.FileEventData{
+		Path:    entry.Path,
+		Content: base64.StdEncoding.EncodeToString(content),
+	})
+
+	author, trailers := commitIdentity(r)
+	h.Committer.Enqueue(vault.CommitRequest{
+		DeviceID: deviceID,
+		Author:   author,
+		Trailers: append(trailers, vault.Trailer{Key: "Restored-From-Trash", Value: entry.Path}),
+		Paths:    []string{entry.Path},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SuccessResponse{Status: "success, file restored and broadcasted"})
+}
+
+// TrashPurgeHandler permanently deletes one trash entry (?id=).
+// Emptying the whole trash needs an explicit all=true and the admin token.
+func (h *ApiHandler) TrashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	id := query.Get("id")
+	switch {
+	case id != "":
+		if err := vault.PurgeTrash(h.VaultPath, id); err != nil {
+			http.Error(w, fmt.Sprintf("Could not purge trash entry %s: %v", id, err), http.StatusNotFound)
+			return
+		}
+		log.Printf("TrashPurgeHandler: Purged trash entry %s.", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TrashPurgeResponse{Status: "success, trash entry purged", Purged: 1})
+	case query.Get("all") == "true":
+		h.RequireAdmin(h.purgeAllTrash)(w, r)
+	default:
+		http.Error(w, "id is required, or all=true with the admin token to empty the trash", http.StatusBadRequest)
+	}
+}
+
+func (h *ApiHandler) purgeAllTrash(w http.ResponseWriter, r *http.Request) {
+	purged, err := vault.PurgeAllTrash(h.VaultPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not purge trash: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("TrashPurgeHandler: Purged all %d trash entries.", purged)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TrashPurgeResponse{Status: "success, trash purged", Purged: purged})
+}
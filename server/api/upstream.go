@@ -0,0 +1,26 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// UpstreamSyncHandler fetches the configured upstream branch right away instead of waiting for the next poll.
+func (h *ApiHandler) UpstreamSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Upstream == nil {
+		http.Error(w, "Upstream sync is not configured", http.StatusNotFound)
+		return
+	}
+	result, err := h.Upstream.Sync()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Upstream sync failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
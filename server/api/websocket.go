@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/metrics"
+)
+
+// largest message a client may send, bigger pushes go through /api/sync/push
+const wsMaxMessageBytes = 64 << 20
+
+// message types on /api/ws
+const (
+	WSTypeEvent      = "event"       // server: one event of the stream, as on /api/events
+	WSTypeHeartbeat  = "heartbeat"   // server: keeps an idle connection open
+	WSTypePush       = "push"        // client: files to update and delete, as the body of /api/sync/push
+	WSTypePushResult = "push_result" // server: a push was applied
+	WSTypeAck        = "ack"         // client: acknowledges the events up to seq
+	WSTypePing       = "ping"        // client: answered with a pong
+	WSTypePong       = "pong"
+	WSTypeError      = "error" // server: a message that could not be handled
+)
+
+// WSClientMessage is a message a client sends on /api/ws.
+type WSClientMessage struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"` // echoed in the reply, to match it with the message
+	Seq  int64  `json:"seq,omitempty"` // of an ack
+	PushRequest
+}
+
+// WSServerMessage is a message the server sends on /api/ws.
+type WSServerMessage struct {
+	Type   string `json:"type"`
+	Ref    string `json:"ref,omitempty"`
+	ID     int64  `json:"id,omitempty"`    // of an event that has to be acknowledged, like the SSE id
+	Event  string `json:"event,omitempty"` // the SSE event name
+	Data   any    `json:"data,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// WebSocketHandler carries the event stream of /api/events plus pushes, acks and pings on one WebSocket connection.
+// It takes the same query parameters as /api/events.
+func (h *ApiHandler) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+	if err := h.checkWebSocketOrigin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// the origin is checked above, the library would only accept origins on the server's own host
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		return // Accept has answered the request
+	}
+	h.serveWebSocket(conn, r, deviceID)
+}
+
+// browsers are held to the CORS origin, other clients send no Origin header
+func (h *ApiHandler) checkWebSocketOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" || h.AllowedOrigin == "*" || origin == h.AllowedOrigin {
+		return nil
+	}
+	return fmt.Errorf("origin %q is not allowed", origin)
+}
+
+func (h *ApiHandler) serveWebSocket(conn *websocket.Conn, r *http.Request, deviceID string) {
+	h.webSockets.Add(1)
+	defer h.webSockets.Done()
+	conn.SetReadLimit(wsMaxMessageBytes)
+	sub, autoAck := h.openSession(r, deviceID)
+	defer h.StateManager.RemoveClient(deviceID, sub)
+	log.Printf("Client %s connected over WebSocket", deviceID)
+
+	// ctx ends the event stream once the reader stops; reads and writes use the request context,
+	// a canceled read or write drops the connection without a close frame
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		defer cancel()
+		h.readWebSocket(conn, r, deviceID)
+	}()
+	h.streamEvents(ctx, deviceID, sub, autoAck, wsSink{ctx: r.Context(), conn: conn})
+	conn.Close(websocket.StatusNormalClosure, "")
+	<-readerDone // a push in progress is finished before the session ends
+}
+
+// handles the messages of a client until the connection closes
+func (h *ApiHandler) readWebSocket(conn *websocket.Conn, r *http.Request, deviceID string) {
+	ctx := r.Context()
+	for {
+		_, raw, err := conn.Read(ctx)
+		if err != nil {
+			status := websocket.CloseStatus(err)
+			if status != websocket.StatusNormalClosure && status != websocket.StatusGoingAway &&
+				!errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("WARN: WebSocket: could not read from client %s: %v", deviceID, err)
+			}
+			return
+		}
+		var msg WSClientMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			sendWebSocket(ctx, conn, WSServerMessage{Type: WSTypeError, Error: fmt.Sprintf("invalid message: %v", err)})
+			continue
+		}
+		switch msg.Type {
+		case WSTypePing:
+			sendWebSocket(ctx, conn, WSServerMessage{Type: WSTypePong, Ref: msg.Ref})
+		case WSTypeAck:
+			h.StateManager.Ack(deviceID, msg.Seq)
+		case WSTypePush:
+			// the drain middleware only sees new requests, this connection was opened before shutdown began
+			if h.Draining.Load() {
+				sendWebSocket(ctx, conn, WSServerMessage{Type: WSTypeError, Ref: msg.Ref, Error: "the server is shutting down, nothing was applied"})
+				continue
+			}
+			start := time.Now()
+			h.StateManager.Touch(deviceID, r.RemoteAddr)
+			err := h.applyPush(r, msg.PushRequest)
+			metrics.PushDuration.Since(start)
+			if err != nil {
+				sendWebSocket(ctx, conn, WSServerMessage{Type: WSTypeError, Ref: msg.Ref, Error: fmt.Sprintf("invalid push, nothing was applied: %v", err)})
+				continue
+			}
+			sendWebSocket(ctx, conn, WSServerMessage{Type: WSTypePushResult, Ref: msg.Ref, Status: pushStatus})
+		default:
+			sendWebSocket(ctx, conn, WSServerMessage{Type: WSTypeError, Ref: msg.Ref, Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+		}
+	}
+}
+
+// the connection serializes writes, so the reader and the event stream may both send
+func sendWebSocket(ctx context.Context, conn *websocket.Conn, msg WSServerMessage) error {
+	return wsjson.Write(ctx, conn, msg)
+}
+
+// wsSink writes events as WebSocket messages.
+type wsSink struct {
+	ctx  context.Context
+	conn *websocket.Conn
+}
+
+func (s wsSink) send(seq int64, eventName string, data any) error {
+	return sendWebSocket(s.ctx, s.conn, WSServerMessage{Type: WSTypeEvent, ID: seq, Event: eventName, Data: data})
+}
+
+func (s wsSink) heartbeat() error {
+	return sendWebSocket(s.ctx, s.conn, WSServerMessage{Type: WSTypeHeartbeat})
+}
+
+func (s wsSink) end(final any) {
+	switch event := final.(type) {
+	case events.ServerShutdownEventData:
+		sendEvent(s, 0, events.SSEEventServerShutdown, event)
+	case events.DisconnectedEventData:
+		sendEvent(s, 0, events.SSEEventDisconnected, event)
+	}
+}
+
+// WaitWebSockets waits for every WebSocket session to end or ctx to be done.
+// http.Server.Shutdown does not wait for them, their connections are hijacked.
+func (h *ApiHandler) WaitWebSockets(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.webSockets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
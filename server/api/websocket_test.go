@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// testSocket is an open /api/ws connection of one device.
+type testSocket struct {
+	t      *testing.T
+	h      *ApiHandler
+	device string
+	conn   *websocket.Conn
+}
+
+// connects to /api/ws with the given query and waits until the server registered the session
+func openTestSocket(t *testing.T, h *ApiHandler, server *httptest.Server, query string) *testSocket {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?" + query
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	s := &testSocket{t: t, h: h, conn: conn}
+	s.device = strings.TrimPrefix(strings.Split(query, "&")[0], "device_id=")
+	waitFor(t, "the session to be registered", func() bool { return h.StateManager.IsClientActive(s.device) })
+	return s
+}
+
+func (s *testSocket) send(msg WSClientMessage) {
+	s.t.Helper()
+	if err := wsjson.Write(context.Background(), s.conn, msg); err != nil {
+		s.t.Fatalf("send %+v: %v", msg, err)
+	}
+}
+
+// the next message that is not a heartbeat
+func (s *testSocket) next() WSServerMessage {
+	s.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		var msg WSServerMessage
+		if err := wsjson.Read(ctx, s.conn, &msg); err != nil {
+			s.t.Fatalf("read: %v", err)
+		}
+		if msg.Type != WSTypeHeartbeat {
+			return msg
+		}
+	}
+}
+
+func (s *testSocket) close() {
+	s.conn.Close(websocket.StatusNormalClosure, "")
+	waitFor(s.t, "the session to end", func() bool { return !s.h.StateManager.IsClientActive(s.device) })
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	h := newTestHandler(t)
+	server := newTestServer(t, h)
+	socket := openTestSocket(t, h, server, "device_id=laptop&acks=true")
+
+	socket.send(WSClientMessage{Type: WSTypePing, Ref: "1"})
+	if msg := socket.next(); msg.Type != WSTypePong || msg.Ref != "1" {
+		t.Errorf("answer to a ping = %+v, want a pong", msg)
+	}
+
+	content := base64.StdEncoding.EncodeToString([]byte("from the laptop"))
+	socket.send(WSClientMessage{Type: WSTypePush, Ref: "2", PushRequest: PushRequest{FilesToUpdate: []vault.File{{Path: "b.md", Content: content}}}})
+	if msg := socket.next(); msg.Type != WSTypePushResult || msg.Ref != "2" {
+		t.Errorf("answer to a push = %+v, want a push_result", msg)
+	}
+	if data, err := os.ReadFile(filepath.Join(h.VaultPath, "b.md")); err != nil || string(data) != "from the laptop" {
+		t.Errorf("b.md = %q (%v) after the push", data, err)
+	}
+
+	socket.send(WSClientMessage{Type: "sing", Ref: "3"})
+	if msg := socket.next(); msg.Type != WSTypeError || msg.Ref != "3" {
+		t.Errorf("answer to an unknown message = %+v, want an error", msg)
+	}
+
+	broadcastUpdate(t, h, "c.md")
+	event := socket.next()
+	if event.Type != WSTypeEvent || event.Event != events.SSEEventFileUpdated || event.ID == 0 || messagePath(t, event) != "c.md" {
+		t.Fatalf("event = %+v, want an update of c.md with an id", event)
+	}
+	socket.send(WSClientMessage{Type: WSTypeAck, Seq: event.ID})
+	socket.send(WSClientMessage{Type: WSTypePing, Ref: "4"}) // answered after the ack was handled
+	socket.next()
+	socket.close()
+
+	// the acknowledged event is not sent again
+	socket = openTestSocket(t, h, server, "device_id=laptop&acks=true")
+	broadcastUpdate(t, h, "d.md")
+	if event := socket.next(); event.Type != WSTypeEvent || messagePath(t, event) != "d.md" {
+		t.Errorf("after reconnecting = %+v, want only the update of d.md", event)
+	}
+	socket.close()
+}
+
+func TestWebSocketRefusesPushesWhileDraining(t *testing.T) {
+	h := newTestHandler(t)
+	server := newTestServer(t, h)
+	socket := openTestSocket(t, h, server, "device_id=laptop")
+	defer socket.close()
+
+	h.Draining.Store(true)
+	content := base64.StdEncoding.EncodeToString([]byte("too late"))
+	socket.send(WSClientMessage{Type: WSTypePush, Ref: "1", PushRequest: PushRequest{FilesToUpdate: []vault.File{{Path: "late.md", Content: content}}}})
+	if msg := socket.next(); msg.Type != WSTypeError || msg.Ref != "1" {
+		t.Errorf("answer to a push while draining = %+v, want an error", msg)
+	}
+	if _, err := os.Stat(filepath.Join(h.VaultPath, "late.md")); !os.IsNotExist(err) {
+		t.Errorf("late.md was written while draining: %v", err)
+	}
+	// acks and pings still work, the client learns about the shutdown from the server_shutdown event
+	socket.send(WSClientMessage{Type: WSTypePing, Ref: "2"})
+	if msg := socket.next(); msg.Type != WSTypePong || msg.Ref != "2" {
+		t.Errorf("answer to a ping while draining = %+v, want a pong", msg)
+	}
+}
+
+// the path of a file event
+func messagePath(t *testing.T, msg WSServerMessage) string {
+	t.Helper()
+	raw, err := json.Marshal(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data events.FileEventData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		t.Fatalf("event %+v: %v", msg, err)
+	}
+	return data.Path
+}
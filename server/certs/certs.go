@@ -0,0 +1,308 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file names inside the self-signed directory
+const (
+	CAFile        = "ca.pem"
+	CAKeyFile     = "ca-key.pem"
+	ServerFile    = "server.pem"
+	ServerKeyFile = "server-key.pem"
+)
+
+const (
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 397 * 24 * time.Hour // the longest lifetime Apple platforms accept
+	renewBefore    = 30 * 24 * time.Hour
+	reloadCheck    = 10 * time.Second // how often a handshake may look for new certificate files
+)
+
+// Reloader serves a certificate and key pair from disk and picks up replaced files without a restart.
+type Reloader struct {
+	certPath string
+	keyPath  string
+	renew    func() error // issues the pair again when it expires soon, nil when it is managed elsewhere
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// loads the pair once, so a broken configuration fails at startup
+func NewReloader(certPath, keyPath string) (*Reloader, error) {
+	r := &Reloader{certPath: certPath, keyPath: keyPath}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	r.cert = &cert
+	r.modTime = r.latestModTime()
+	r.lastCheck = time.Now()
+	return r, nil
+}
+
+// loads the self-signed server certificate for hosts in dir, see EnsureSelfSigned, and keeps issuing it
+// again from the same CA while the server runs, whenever it is about to expire
+func NewSelfSignedReloader(dir string, hosts []string) (*Reloader, SelfSigned, error) {
+	selfSigned, err := EnsureSelfSigned(dir, hosts)
+	if err != nil {
+		return nil, selfSigned, err
+	}
+	r, err := NewReloader(selfSigned.ServerCert, selfSigned.ServerKey)
+	if err != nil {
+		return nil, selfSigned, err
+	}
+	r.renew = func() error {
+		_, err := EnsureSelfSigned(dir, hosts)
+		return err
+	}
+	return r, selfSigned, nil
+}
+
+// tls.Config.GetCertificate hook, reloads the files when either changed
+// a pair that fails to load is logged and the previous certificate is kept
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.lastCheck) < reloadCheck {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	if r.renew != nil && time.Until(r.cert.Leaf.NotAfter) < renewBefore {
+		// the new files are picked up right below
+		if err := r.renew(); err != nil {
+			slog.Error("tls: could not issue the server certificate again", "cert", r.certPath, "error", err)
+		}
+	}
+	modTime := r.latestModTime()
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		slog.Error("tls: could not reload certificate, keeping the previous one", "cert", r.certPath, "error", err)
+		return r.cert, nil
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	slog.Info("tls: certificate reloaded", "cert", r.certPath, "fingerprint", Fingerprint(cert.Certificate[0]))
+	return r.cert, nil
+}
+
+// returns the leaf certificate currently served
+func (r *Reloader) Leaf() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cert.Certificate[0]
+}
+
+func (r *Reloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// SelfSigned describes the certificates created by EnsureSelfSigned.
+type SelfSigned struct {
+	CACert     string // path of the CA certificate, the one to trust or pin on devices
+	ServerCert string
+	ServerKey  string
+	CA         []byte // DER of the CA certificate
+}
+
+// creates a CA and a server certificate for hosts in dir, or reuses them from an earlier start
+// the CA is kept for good; the server certificate is issued again when it expires soon or misses a host
+func EnsureSelfSigned(dir string, hosts []string) (SelfSigned, error) {
+	result := SelfSigned{
+		CACert:     filepath.Join(dir, CAFile),
+		ServerCert: filepath.Join(dir, ServerFile),
+		ServerKey:  filepath.Join(dir, ServerKeyFile),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return result, err
+	}
+	ca, caKey, err := loadOrCreateCA(dir)
+	if err != nil {
+		return result, err
+	}
+	result.CA = ca.Raw
+	if current, err := tls.LoadX509KeyPair(result.ServerCert, result.ServerKey); err == nil && coversHosts(current.Leaf, ca, hosts) {
+		return result, nil
+	}
+	slog.Info("tls: issuing server certificate", "hosts", hosts)
+	return result, issueServerCert(result, ca, caKey, hosts)
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath, keyPath := filepath.Join(dir, CAFile), filepath.Join(dir, CAKeyFile)
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not an ECDSA key", keyPath)
+		}
+		return pair.Leaf, key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("could not load CA: %w", err)
+	}
+
+	slog.Info("tls: creating self-signed CA", "dir", dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.Subject = pkix.Name{CommonName: "Yamanaka Local CA", Organization: []string{"Yamanaka"}}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePair(certPath, keyPath, der, key); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+func issueServerCert(paths SelfSigned, ca *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := newTemplate(serverValidity)
+	if err != nil {
+		return err
+	}
+	template.Subject = pkix.Name{CommonName: hosts[0], Organization: []string{"Yamanaka"}}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	// the chain lets clients that only pin or trust the CA verify the server certificate
+	return writePair(paths.ServerCert, paths.ServerKey, der, key, ca.Raw)
+}
+
+func newTemplate(validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// writes a certificate chain and its key as PEM, the key readable by the owner only
+func writePair(certPath, keyPath string, leaf []byte, key *ecdsa.PrivateKey, chain ...[]byte) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range append([][]byte{leaf}, chain...) {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return os.WriteFile(certPath, certPEM, 0644)
+}
+
+// reports whether cert was issued by ca, stays valid for a while and names every host
+func coversHosts(cert, ca *x509.Certificate, hosts []string) bool {
+	if cert == nil || cert.CheckSignatureFrom(ca) != nil || time.Until(cert.NotAfter) < renewBefore {
+		return false
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+				return false
+			}
+		} else if !slices.Contains(cert.DNSNames, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// the names a self-signed server certificate is issued for: localhost, the host name,
+// every local interface address and any extra hosts
+func DefaultHosts(extra []string) []string {
+	hosts := []string{"localhost"}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+	}
+	hosts = append(hosts, "127.0.0.1", "::1")
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				hosts = append(hosts, ipNet.IP.String())
+			}
+		}
+	}
+	hosts = append(hosts, extra...)
+	var unique []string
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" && !slices.Contains(unique, host) {
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
+
+// SHA-256 fingerprint of a DER certificate, as colon separated hex
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	parts := make([]string, 0, len(sum))
+	for i := 0; i < len(hexSum); i += 2 {
+		parts = append(parts, hexSum[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,162 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replaces the server pair in dir with one from the same CA that expires after validity
+func writeExpiringServerCert(t *testing.T, dir string, validity time.Duration) {
+	t.Helper()
+	caPair, err := tls.LoadX509KeyPair(filepath.Join(dir, CAFile), filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := newTemplate(validity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.DNSNames = []string{"localhost"}
+	der, err := x509.CreateCertificate(rand.Reader, template, caPair.Leaf, &key.PublicKey, caPair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePair(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), der, key, caPair.Leaf.Raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	first, err := EnsureSelfSigned(dir, []string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("EnsureSelfSigned: %v", err)
+	}
+	pair, err := tls.LoadX509KeyPair(first.ServerCert, first.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(first.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if _, err := pair.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: host}); err != nil {
+			t.Errorf("server certificate does not verify for %s: %v", host, err)
+		}
+	}
+	for _, path := range []string{filepath.Join(dir, CAKeyFile), first.ServerKey} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: mode %v (%v), want 0600", path, info.Mode().Perm(), err)
+		}
+	}
+	serverPEM, _ := os.ReadFile(first.ServerCert)
+
+	tests := []struct {
+		name      string
+		prepare   func()
+		hosts     []string
+		wantReuse bool
+	}{
+		{"same hosts", func() {}, []string{"localhost", "127.0.0.1"}, true},
+		{"fewer hosts", func() {}, []string{"localhost"}, true},
+		{"new host", func() {}, []string{"localhost", "vault.lan"}, false},
+		{"about to expire", func() { writeExpiringServerCert(t, dir, 24*time.Hour) }, []string{"localhost"}, false},
+	}
+	for _, tt := range tests {
+		tt.prepare()
+		before, _ := os.ReadFile(first.ServerCert)
+		again, err := EnsureSelfSigned(dir, tt.hosts)
+		if err != nil {
+			t.Fatalf("%s: EnsureSelfSigned: %v", tt.name, err)
+		}
+		if !bytes.Equal(again.CA, first.CA) {
+			t.Errorf("%s: a new CA was created", tt.name)
+		}
+		after, _ := os.ReadFile(first.ServerCert)
+		if reused := bytes.Equal(before, after); reused != tt.wantReuse {
+			t.Errorf("%s: server certificate reused = %v, want %v", tt.name, reused, tt.wantReuse)
+		}
+	}
+	if after, _ := os.ReadFile(first.ServerCert); bytes.Equal(after, serverPEM) {
+		t.Errorf("the first server certificate is still in place")
+	}
+}
+
+func TestReloaderRenewsSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	reloader, selfSigned, err := NewSelfSignedReloader(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("NewSelfSignedReloader: %v", err)
+	}
+	original := reloader.Leaf()
+
+	// within the check interval the files are not looked at
+	writeExpiringServerCert(t, dir, 24*time.Hour)
+	if cert, _ := reloader.GetCertificate(nil); !bytes.Equal(cert.Certificate[0], original) {
+		t.Errorf("certificate changed within the check interval")
+	}
+
+	// the replaced pair is picked up, and on the next check issued again because it expires soon
+	reloader.lastCheck = time.Time{}
+	cert, _ := reloader.GetCertificate(nil)
+	if bytes.Equal(cert.Certificate[0], original) || time.Until(cert.Leaf.NotAfter) > renewBefore {
+		t.Fatalf("the replaced certificate was not loaded")
+	}
+	reloader.lastCheck = time.Time{}
+	cert, _ = reloader.GetCertificate(nil)
+	if time.Until(cert.Leaf.NotAfter) < renewBefore {
+		t.Errorf("certificate expires %v, want it issued again", cert.Leaf.NotAfter)
+	}
+	onDisk, err := tls.LoadX509KeyPair(selfSigned.ServerCert, selfSigned.ServerKey)
+	if err != nil || !bytes.Equal(onDisk.Certificate[0], cert.Certificate[0]) {
+		t.Errorf("the served certificate is not the one on disk (%v)", err)
+	}
+}
+
+func TestReloaderKeepsCertificateOnBrokenFiles(t *testing.T) {
+	dir := t.TempDir()
+	selfSigned, err := EnsureSelfSigned(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewReloader(selfSigned.ServerCert, selfSigned.ServerKey)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	original := reloader.Leaf()
+
+	if err := os.WriteFile(selfSigned.ServerKey, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloader.lastCheck = time.Time{}
+	if cert, err := reloader.GetCertificate(nil); err != nil || !bytes.Equal(cert.Certificate[0], original) {
+		t.Errorf("GetCertificate() = %v, want the previous certificate kept", err)
+	}
+
+	// a reloader without renewal serves an expiring certificate as it is
+	writeExpiringServerCert(t, dir, 24*time.Hour)
+	reloader.lastCheck = time.Time{}
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil || time.Until(cert.Leaf.NotAfter) > renewBefore {
+		t.Errorf("GetCertificate() = %v, want the replaced certificate", err)
+	}
+
+	if _, err := NewReloader(filepath.Join(dir, "missing.pem"), selfSigned.ServerKey); err == nil {
+		t.Errorf("NewReloader() with a missing certificate succeeded")
+	}
+}
@@ -0,0 +1,401 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/vault"
+)
+
+// DefaultFile is read when no config file is given and it exists in the working directory.
+const DefaultFile = "yamanaka.json"
+
+const envPrefix = "YAMANAKA_"
+
+// Config holds every server setting. Sources are applied in this order, later ones win:
+// defaults, the JSON config file, YAMANAKA_* environment variables, command line flags.
+// Each json key doubles as the environment variable (upper case, YAMANAKA_ prefix) and the flag (dashes).
+type Config struct {
+	DataDir    string `json:"data_dir" help:"directory holding the vault and its git history"`
+	Addr       string `json:"addr" help:"address the HTTP server listens on"`
+	CORSOrigin string `json:"cors_origin" help:"value of Access-Control-Allow-Origin"`
+	AdminToken string `json:"admin_token" help:"bearer token for the /api/admin endpoints, empty disables them"`
+
+	TLSCert       string   `json:"tls_cert" help:"PEM certificate file, serves HTTPS when set together with tls_key"`
+	TLSKey        string   `json:"tls_key" help:"PEM private key file of tls_cert"`
+	TLSSelfSigned bool     `json:"tls_self_signed" help:"serve HTTPS with a self-signed CA and certificate created in tls_dir"`
+	TLSDir        string   `json:"tls_dir" help:"directory keeping the self-signed CA and server certificate"`
+	TLSHosts      []string `json:"tls_hosts" help:"comma separated extra host names and IPs for the self-signed certificate"`
+
+	ShutdownTimeout    Duration `json:"shutdown_timeout" help:"how long a stopping server waits for requests in flight"`
+	ShutdownRetryAfter Duration `json:"shutdown_retry_after" help:"reconnect delay suggested to clients when the server stops"`
+
+	CommitInterval    Duration `json:"commit_interval" help:"interval of the periodic fallback commit"`
+	CommitQuietWindow Duration `json:"commit_quiet_window" help:"pushes are committed once no push arrived for this long"`
+	CommitMaxDelay    Duration `json:"commit_max_delay" help:"longest a queued push waits for its commit"`
+
+	MissedEventsThreshold int      `json:"missed_events_threshold" help:"a reconnecting device with more missed events gets a full sync instead"`
+	HeartbeatInterval     Duration `json:"heartbeat_interval" help:"interval of SSE heartbeat comments"`
+	ClientQueueSize       int      `json:"client_queue_size" help:"events a connected client may fall behind before it is disconnected"`
+	HealthMinFreeDiskMB   int      `json:"health_min_free_disk_mb" help:"readiness fails when less disk space is free, in MiB"`
+	HealthMaxCommitAge    Duration `json:"health_max_commit_age" help:"readiness warns when the newest commit is older, 0 disables it"`
+	WatchDebounce         Duration `json:"watch_debounce" help:"quiet time before edits made directly in the data directory are committed"`
+
+	DeviceInactivityTTL Duration `json:"device_inactivity_ttl" help:"devices not seen for this long become dormant and stop collecting events, 0 disables it"`
+
+	TrashRetention     Duration `json:"trash_retention" help:"how long deleted files stay in the trash"`
+	TrashPurgeInterval Duration `json:"trash_purge_interval" help:"interval of the expired trash purge"`
+
+	HistoryKeepAll      Duration `json:"history_keep_all" help:"every commit younger than this survives compaction"`
+	HistoryHourly       Duration `json:"history_hourly" help:"up to this age one commit per hour survives compaction, then one per day"`
+	MaintenanceInterval Duration `json:"maintenance_interval" help:"interval of history compaction and gc"`
+
+	MirrorURLs             []string `json:"mirror_urls" help:"comma separated git remotes the history is pushed to"`
+	MirrorUsername         string   `json:"mirror_username" help:"HTTP username for mirror and upstream remotes"`
+	MirrorPassword         string   `json:"mirror_password" help:"HTTP password or token for mirror and upstream remotes"`
+	MirrorSSHKey           string   `json:"mirror_ssh_key" help:"SSH private key file for mirror and upstream remotes"`
+	MirrorSSHKeyPassphrase string   `json:"mirror_ssh_key_passphrase" help:"passphrase of the SSH private key"`
+
+	UpstreamURL      string   `json:"upstream_url" help:"git remote whose branch is pulled into the vault, empty to disable"`
+	UpstreamBranch   string   `json:"upstream_branch" help:"branch of the upstream remote"`
+	UpstreamInterval Duration `json:"upstream_interval" help:"interval of upstream fetches"`
+}
+
+// settings that are masked by Redacted
+var secretKeys = map[string]bool{"admin_token": true, "mirror_password": true, "mirror_ssh_key_passphrase": true}
+
+// returns the built-in settings
+func Default() *Config {
+	return &Config{
+		DataDir:               "./data",
+		Addr:                  ":8080",
+		CORSOrigin:            "app://obsidian.md",
+		TLSDir:                "./tls",
+		ShutdownTimeout:       Duration(30 * time.Second),
+		ShutdownRetryAfter:    Duration(10 * time.Second),
+		CommitInterval:        Duration(6 * time.Hour),
+		CommitQuietWindow:     Duration(10 * time.Second),
+		CommitMaxDelay:        Duration(2 * time.Minute),
+		MissedEventsThreshold: 10,
+		HeartbeatInterval:     Duration(2 * time.Minute),
+		ClientQueueSize:       256,
+		HealthMinFreeDiskMB:   100,
+		WatchDebounce:         Duration(2 * time.Second),
+		DeviceInactivityTTL:   Duration(30 * 24 * time.Hour),
+		TrashRetention:        Duration(30 * 24 * time.Hour),
+		TrashPurgeInterval:    Duration(time.Hour),
+		HistoryKeepAll:        Duration(7 * 24 * time.Hour),
+		HistoryHourly:         Duration(30 * 24 * time.Hour),
+		MaintenanceInterval:   Duration(24 * time.Hour),
+		UpstreamBranch:        "master",
+		UpstreamInterval:      Duration(5 * time.Minute),
+	}
+}
+
+// Duration is a time.Duration written as "90s", "6h" or a number of days such as "7d".
+type Duration time.Duration
+
+func ParseDuration(value string) (Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return Duration(time.Duration(n) * 24 * time.Hour), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return Duration(d), nil
+}
+
+func (d Duration) String() string {
+	if day := 24 * time.Hour; d > 0 && time.Duration(d)%day == 0 {
+		return strconv.FormatInt(int64(time.Duration(d)/day), 10) + "d"
+	}
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"90s\" or \"7d\"")
+	}
+	parsed, err := ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// one settable field of Config
+type field struct {
+	key   string
+	env   string
+	flag  string
+	help  string
+	value reflect.Value
+}
+
+func (c *Config) fields() []field {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("json")
+		fields = append(fields, field{
+			key:   key,
+			env:   envPrefix + strings.ToUpper(key),
+			flag:  strings.ReplaceAll(key, "_", "-"),
+			help:  t.Field(i).Tag.Get("help"),
+			value: v.Field(i),
+		})
+	}
+	return fields
+}
+
+// parses a string into the field, the same syntax is used by environment variables and flags
+func (f field) set(raw string) error {
+	switch ptr := f.value.Addr().Interface().(type) {
+	case *string:
+		*ptr = raw
+	case *bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", f.key)
+		}
+		*ptr = b
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s must be a number", f.key)
+		}
+		*ptr = n
+	case *Duration:
+		d, err := ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.key, err)
+		}
+		*ptr = d
+	case *[]string:
+		*ptr = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*ptr = append(*ptr, item)
+			}
+		}
+	default:
+		return fmt.Errorf("%s has an unsupported type", f.key)
+	}
+	return nil
+}
+
+func (f field) String() string {
+	switch value := f.value.Interface().(type) {
+	case []string:
+		return strings.Join(value, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// builds the configuration from defaults, the config file, the environment and args (without the program name)
+// printOnly is true when --print-config was given
+func Load(args []string) (cfg *Config, printOnly bool, err error) {
+	cfg = Default()
+	flags := flag.NewFlagSet("yamanaka", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv(envPrefix+"CONFIG"), "JSON config file (env "+envPrefix+"CONFIG, default ./"+DefaultFile+" if it exists)")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration and exit")
+	fields := cfg.fields()
+	byFlag := make(map[string]field, len(fields))
+	for _, f := range fields {
+		if f.value.Kind() == reflect.Bool {
+			flags.Bool(f.flag, f.value.Bool(), f.help+" (env "+f.env+")")
+		} else {
+			flags.String(f.flag, f.String(), f.help+" (env "+f.env+")")
+		}
+		byFlag[f.flag] = f
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if flags.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	path, explicit := *configPath, *configPath != ""
+	if !explicit {
+		path = DefaultFile
+	}
+	if err := cfg.loadFile(path, explicit); err != nil {
+		return nil, false, err
+	}
+	for _, f := range fields {
+		if raw, ok := os.LookupEnv(f.env); ok {
+			if err := f.set(raw); err != nil {
+				return nil, false, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+	var flagErr error
+	flags.Visit(func(fl *flag.Flag) {
+		if f, ok := byFlag[fl.Name]; ok && flagErr == nil {
+			if err := f.set(fl.Value.String()); err != nil {
+				flagErr = fmt.Errorf("--%s: %w", fl.Name, err)
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, false, flagErr
+	}
+	return cfg, *printConfig, cfg.Validate()
+}
+
+// reads a JSON config file over the current values, a missing file is only an error if it was asked for
+func (c *Config) loadFile(path string, required bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// checks every setting and reports all problems at once
+func (c *Config) Validate() error {
+	var problems []string
+	for key, value := range map[string]string{"data_dir": c.DataDir, "addr": c.Addr, "cors_origin": c.CORSOrigin} {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, key+" must not be empty")
+		}
+	}
+	for key, d := range map[string]Duration{
+		"shutdown_timeout":     c.ShutdownTimeout,
+		"shutdown_retry_after": c.ShutdownRetryAfter,
+		"commit_interval":      c.CommitInterval,
+		"commit_quiet_window":  c.CommitQuietWindow,
+		"commit_max_delay":     c.CommitMaxDelay,
+		"heartbeat_interval":   c.HeartbeatInterval,
+		"watch_debounce":       c.WatchDebounce,
+		"trash_purge_interval": c.TrashPurgeInterval,
+		"maintenance_interval": c.MaintenanceInterval,
+		"upstream_interval":    c.UpstreamInterval,
+	} {
+		if d <= 0 {
+			problems = append(problems, key+" must be positive")
+		}
+	}
+	for key, d := range map[string]Duration{"device_inactivity_ttl": c.DeviceInactivityTTL, "health_max_commit_age": c.HealthMaxCommitAge, "trash_retention": c.TrashRetention, "history_keep_all": c.HistoryKeepAll, "history_hourly": c.HistoryHourly} {
+		if d < 0 {
+			problems = append(problems, key+" must not be negative")
+		}
+	}
+	if c.CommitMaxDelay < c.CommitQuietWindow {
+		problems = append(problems, "commit_max_delay must not be shorter than commit_quiet_window")
+	}
+	if c.HistoryHourly < c.HistoryKeepAll {
+		problems = append(problems, "history_hourly must not be shorter than history_keep_all")
+	}
+	if c.MissedEventsThreshold < 0 {
+		problems = append(problems, "missed_events_threshold must not be negative")
+	}
+	if c.ClientQueueSize < 1 {
+		problems = append(problems, "client_queue_size must be at least 1")
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < 16 {
+		problems = append(problems, "admin_token must be at least 16 characters")
+	}
+	if c.HealthMinFreeDiskMB < 0 {
+		problems = append(problems, "health_min_free_disk_mb must not be negative")
+	}
+	for _, remote := range append(append([]string{}, c.MirrorURLs...), c.UpstreamURL) {
+		if remote != "" && strings.Contains(remote, "://") {
+			if _, err := url.Parse(remote); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid remote URL %q", vault.RedactURL(remote)))
+			}
+		}
+	}
+	if c.MirrorSSHKey != "" {
+		if _, err := os.Stat(c.MirrorSSHKey); err != nil {
+			problems = append(problems, fmt.Sprintf("mirror_ssh_key: %v", err))
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problems = append(problems, "tls_cert and tls_key must be set together")
+	}
+	if c.TLSCert != "" && c.TLSSelfSigned {
+		problems = append(problems, "tls_self_signed cannot be combined with tls_cert")
+	}
+	for key, path := range map[string]string{"tls_cert": c.TLSCert, "tls_key": c.TLSKey} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if c.TLSSelfSigned && strings.TrimSpace(c.TLSDir) == "" {
+		problems = append(problems, "tls_dir must not be empty when tls_self_signed is set")
+	}
+	if c.UpstreamURL != "" && strings.TrimSpace(c.UpstreamBranch) == "" {
+		problems = append(problems, "upstream_branch must not be empty when upstream_url is set")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+}
+
+// a copy safe to print: secrets are masked and credentials removed from URLs
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.MirrorURLs = nil
+	for _, remote := range c.MirrorURLs {
+		redacted.MirrorURLs = append(redacted.MirrorURLs, vault.RedactURL(remote))
+	}
+	redacted.UpstreamURL = vault.RedactURL(c.UpstreamURL)
+	for _, f := range redacted.fields() {
+		if secretKeys[f.key] && f.value.String() != "" {
+			f.value.SetString("********")
+		}
+	}
+	return &redacted
+}
+
+// reports whether the server serves HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCert != "" || c.TLSSelfSigned
+}
+
+// writes the effective configuration as JSON
+func (c *Config) Print(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(c.Redacted())
+}
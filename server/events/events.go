@@ -6,6 +6,9 @@ const (
 	SSEEventFileUpdated      = "file_updated"
 	SSEEventFileDeleted      = "file_deleted"
 	SSEEventFullSyncRequired = "full_sync_required" // Sent when a client does an initial sync
+	SSEEventCommitCreated    = "commit_created"     // Sent when queued pushes have been committed to git
+	SSEEventServerShutdown   = "server_shutdown"    // Sent to connected clients right before the server stops
+	SSEEventDisconnected     = "disconnected"       // Sent when the server ends a stream, with the reason
 )
 
 // FileEventData is the payload for file-specific SSE events.
@@ -21,3 +24,26 @@ type FullSyncEventData struct {
 	Message        string `json:"message"`
 	SenderDeviceID string `json:"-"` // Used internally to prevent echo, not marshalled
 }
+
+// CommitEventData is the payload for a commit_created SSE event.
+// It is informational only and is not queued for offline clients.
+type CommitEventData struct {
+	Hash           string   `json:"hash"`
+	DeviceIDs      []string `json:"device_ids"`
+	Paths          []string `json:"paths,omitempty"`
+	SenderDeviceID string   `json:"-"` // Used internally to prevent echo, not marshalled
+}
+
+// ServerShutdownEventData is the payload for a server_shutdown SSE event.
+// The connection is closed right after it, clients should reconnect after RetryAfter seconds.
+type ServerShutdownEventData struct {
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+// DisconnectedEventData is the payload for a disconnected SSE event.
+// Events queued for the client are kept, it resumes from its last acknowledged event when it reconnects.
+type DisconnectedEventData struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
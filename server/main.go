@@ -1,29 +1,39 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/tanq16/yamanaka/server/api"
+	"github.com/tanq16/yamanaka/server/certs"
+	"github.com/tanq16/yamanaka/server/config"
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/metrics"
 	"github.com/tanq16/yamanaka/server/state"
 	"github.com/tanq16/yamanaka/server/vault"
 )
 
 const (
-	dataDir              = "./data"
-	serverAddr           = ":8080"
-	gitCommitInterval    = 6 * time.Hour
 	periodicCommitUserID = "server_periodic_commit"
+	dormantCheckInterval = time.Hour
 )
 
 // goroutine to periodically commit changes in the vault
-func startPeriodicGitCommits(vaultPath string) {
-	slog.Info("git-goroutine: started", "interval", gitCommitInterval)
-	ticker := time.NewTicker(gitCommitInterval)
+func startPeriodicGitCommits(vaultPath string, interval time.Duration) {
+	slog.Info("git-goroutine: started", "interval", interval)
+	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
 			commitMsg := "Yamanaka git sync"
@@ -37,8 +47,89 @@ func startPeriodicGitCommits(vaultPath string) {
 	}()
 }
 
+// goroutine to periodically purge trash entries older than the retention
+func startTrashPurge(vaultPath string, retention, interval time.Duration) {
+	slog.Info("trash-goroutine: started", "retention", retention)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			purged, err := vault.PurgeExpiredTrash(vaultPath, retention)
+			if err != nil {
+				slog.Error("trash-goroutine: failed to purge trash", "error", err)
+				continue
+			}
+			if purged > 0 {
+				slog.Info("trash-goroutine: expired entries purged", "count", purged)
+			}
+		}
+	}()
+}
+
+// goroutine to periodically mark devices that were not seen for ttl as dormant
+func startDormantCheck(stateManager *state.Manager, ttl time.Duration) {
+	slog.Info("device-goroutine: started", "inactivity ttl", ttl)
+	check := func() {
+		if dormant := stateManager.MarkDormant(ttl); len(dormant) > 0 {
+			slog.Info("device-goroutine: devices marked dormant", "devices", dormant)
+		}
+	}
+	ticker := time.NewTicker(dormantCheckInterval)
+	go func() {
+		check()
+		for range ticker.C {
+			check()
+		}
+	}()
+}
+
+// builds the mirror remotes, the credentials apply to every remote
+func mirrorRemotes(cfg *config.Config) []vault.Remote {
+	var remotes []vault.Remote
+	for _, url := range cfg.MirrorURLs {
+		remotes = append(remotes, vault.Remote{
+			URL:        url,
+			Username:   cfg.MirrorUsername,
+			Password:   cfg.MirrorPassword,
+			SSHKeyPath: cfg.MirrorSSHKey,
+			SSHKeyPass: cfg.MirrorSSHKeyPassphrase,
+		})
+	}
+	return remotes
+}
+
+// builds the optional upstream remote, it shares the mirror credentials
+func upstreamRemote(cfg *config.Config) (vault.Remote, bool) {
+	if cfg.UpstreamURL == "" {
+		return vault.Remote{}, false
+	}
+	return vault.Remote{
+		Name:       "upstream",
+		URL:        cfg.UpstreamURL,
+		Username:   cfg.MirrorUsername,
+		Password:   cfg.MirrorPassword,
+		SSHKeyPath: cfg.MirrorSSHKey,
+		SSHKeyPass: cfg.MirrorSSHKeyPassphrase,
+	}, true
+}
+
 func main() {
-	vaultPath, _ := filepath.Abs(dataDir)
+	cfg, printOnly, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("could not load configuration", "error", err)
+		os.Exit(2)
+	}
+	if printOnly {
+		if err := cfg.Print(os.Stdout); err != nil {
+			slog.Error("could not print configuration", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	vaultPath, _ := filepath.Abs(cfg.DataDir)
 	if _, err := os.Stat(vaultPath); os.IsNotExist(err) {
 		slog.Info("data directory not found, creating", "vault path", vaultPath)
 		if err := os.MkdirAll(vaultPath, 0755); err != nil {
@@ -52,9 +143,57 @@ func main() {
 	slog.Info("vault ready")
 
 	stateManager := state.NewManager(vaultPath)
+	stateManager.QueueSize = cfg.ClientQueueSize
 	slog.Info("state manager initialized")
-	apiHandler := api.NewApiHandler(stateManager, vaultPath)
-	startPeriodicGitCommits(vaultPath)
+	mirror := vault.NewMirror(vaultPath, mirrorRemotes(cfg))
+	mirror.Start()
+	committer := vault.NewCommitter(vaultPath, time.Duration(cfg.CommitQuietWindow), time.Duration(cfg.CommitMaxDelay), func(result vault.CommitResult) {
+		if result.Err != nil {
+			return
+		}
+		mirror.Notify()
+		stateManager.Broadcast("", events.CommitEventData{
+			Hash:      result.Hash,
+			DeviceIDs: result.DeviceIDs,
+			Paths:     result.Paths,
+		})
+	})
+	committer.Start()
+	apiHandler := api.NewApiHandler(stateManager, committer, mirror, vaultPath)
+	apiHandler.MissedEventsThreshold = cfg.MissedEventsThreshold
+	apiHandler.HeartbeatInterval = time.Duration(cfg.HeartbeatInterval)
+	apiHandler.MinFreeDisk = uint64(cfg.HealthMinFreeDiskMB) << 20
+	apiHandler.MaxCommitAge = time.Duration(cfg.HealthMaxCommitAge)
+	apiHandler.AdminToken = cfg.AdminToken
+	apiHandler.AllowedOrigin = cfg.CORSOrigin
+	if remote, ok := upstreamRemote(cfg); ok {
+		apiHandler.Upstream = vault.NewUpstream(vaultPath, remote, cfg.UpstreamBranch, time.Duration(cfg.UpstreamInterval), committer, func(result vault.IngestResult) {
+			apiHandler.BroadcastChanges(result.Changes, result.To)
+			mirror.Notify()
+		})
+		apiHandler.Upstream.Start()
+	}
+	retention := vault.RetentionPolicy{KeepAll: time.Duration(cfg.HistoryKeepAll), Hourly: time.Duration(cfg.HistoryHourly)}
+	apiHandler.Maintenance = vault.NewMaintenance(vaultPath, retention, time.Duration(cfg.MaintenanceInterval), committer, apiHandler.Upstream, mirror.Names(), func(report vault.MaintenanceReport) {
+		mirror.NotifyRewrite()
+	})
+	apiHandler.Maintenance.Start()
+	watcher, err := vault.NewWatcher(vaultPath, time.Duration(cfg.WatchDebounce), func(hash string, changes []vault.PathChange) {
+		apiHandler.BroadcastChanges(changes, hash)
+		mirror.Notify()
+	})
+	if err != nil {
+		slog.Error("could not watch data directory, external edits will only be picked up by periodic commits", "error", err)
+	} else {
+		watcher.Start()
+	}
+	startPeriodicGitCommits(vaultPath, time.Duration(cfg.CommitInterval))
+	startTrashPurge(vaultPath, time.Duration(cfg.TrashRetention), time.Duration(cfg.TrashPurgeInterval))
+	if cfg.DeviceInactivityTTL > 0 {
+		startDormantCheck(stateManager, time.Duration(cfg.DeviceInactivityTTL))
+	}
+
+	registerMetrics(vaultPath, stateManager)
 
 	// http routes
 	mux := http.NewServeMux()
@@ -63,24 +202,183 @@ func main() {
 	mux.HandleFunc("/api/sync/push", apiHandler.PushHandler)
 	mux.HandleFunc("/api/sync/pull", apiHandler.PullHandler)
 	mux.HandleFunc("/api/events", apiHandler.EventsHandler)
+	mux.HandleFunc("/api/events/ack", apiHandler.AckHandler)
+	mux.HandleFunc("/api/ws", apiHandler.WebSocketHandler)
+	mux.HandleFunc("/api/diff", apiHandler.DiffHandler)
+	mux.HandleFunc("/api/rollback", apiHandler.RollbackHandler)
+	mux.HandleFunc("/api/trash", apiHandler.TrashListHandler)
+	mux.HandleFunc("/api/trash/restore", apiHandler.TrashRestoreHandler)
+	mux.HandleFunc("/api/trash/purge", apiHandler.TrashPurgeHandler)
+	mux.HandleFunc("/api/mirror/status", apiHandler.MirrorStatusHandler)
+	mux.HandleFunc("/api/upstream/sync", apiHandler.UpstreamSyncHandler)
+	mux.HandleFunc("/api/snapshots", apiHandler.SnapshotsHandler)
+	mux.HandleFunc("/api/snapshots/delete", apiHandler.SnapshotDeleteHandler)
+	mux.HandleFunc("/api/snapshots/download", apiHandler.SnapshotDownloadHandler)
+	mux.HandleFunc("/api/snapshots/restore", apiHandler.SnapshotRestoreHandler)
+	mux.HandleFunc("/api/admin/maintenance", apiHandler.RequireAdmin(apiHandler.MaintenanceHandler))
+	mux.HandleFunc("/api/admin/devices", apiHandler.RequireAdmin(apiHandler.DevicesHandler))
+	mux.HandleFunc("/api/admin/devices/disconnect", apiHandler.RequireAdmin(apiHandler.DeviceDisconnectHandler))
+	mux.HandleFunc("/api/admin/devices/backlog/clear", apiHandler.RequireAdmin(apiHandler.DeviceBacklogClearHandler))
+	mux.HandleFunc("/api/admin/devices/backlog/drop", apiHandler.RequireAdmin(apiHandler.DeviceBacklogDropHandler))
+	mux.HandleFunc("/api/admin/devices/remove", apiHandler.RequireAdmin(apiHandler.DeviceRemoveHandler))
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.HandleFunc("/healthz", apiHandler.LivenessHandler)
+	mux.HandleFunc("/readyz", apiHandler.ReadinessHandler)
 	// simple root handler for health checks
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Yamanaka Sync Server is running."))
 	})
 
-	slog.Info("starting server", "address", serverAddr)
-	corsMux := corsMiddleware(mux)
-	if err := http.ListenAndServe(serverAddr, corsMux); err != nil {
+	retryAfter := time.Duration(cfg.ShutdownRetryAfter)
+	server := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: corsMiddleware(drainMiddleware(deviceIDMiddleware(mux), &apiHandler.Draining, retryAfter), cfg.CORSOrigin),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	if cfg.TLSEnabled() {
+		tlsConfig, err := serverTLS(cfg)
+		if err != nil {
+			slog.Error("could not set up tls", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
+	}
+	go func() {
+		slog.Info("starting server", "address", cfg.Addr, "tls", cfg.TLSEnabled())
+		if server.TLSConfig != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-serveErr:
 		slog.Error("could not start server", "error", err)
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process right away
+
+	slog.Info("shutting down", "timeout", time.Duration(cfg.ShutdownTimeout))
+	apiHandler.Draining.Store(true)
+	stateManager.Shutdown(events.ServerShutdownEventData{
+		Message:    "The server is shutting down.",
+		RetryAfter: int(retryAfter.Seconds()),
+	})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("requests still running at shutdown", "error", err)
+	}
+	if err := apiHandler.WaitWebSockets(shutdownCtx); err != nil {
+		slog.Error("websocket sessions still open at shutdown", "error", err)
+	}
+	committer.Flush()
+	if hash, err := vault.CommitChanges(vaultPath, "Yamanaka shutdown commit"); err != nil {
+		slog.Error("final commit failed", "error", err)
+	} else {
+		slog.Info("final commit done", "hash", hash)
+	}
+	state.FlushMissedEvents()
+	slog.Info("server stopped")
+}
+
+// registers the gauges read on every scrape
+// walking the vault is cached briefly so a scrape reads it once for both vault gauges
+func registerMetrics(vaultPath string, stateManager *state.Manager) {
+	var mutex sync.Mutex
+	var files int
+	var size int64
+	var readAt time.Time
+	vaultStats := func() (int, int64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if time.Since(readAt) > 5*time.Second {
+			var err error
+			if files, size, err = vault.VaultStats(vaultPath); err != nil {
+				slog.Warn("metrics: could not read vault size", "error", err)
+			}
+			readAt = time.Now()
+		}
+		return files, size
+	}
+	metrics.GaugeFunc("yamanaka_sse_clients", "Clients with an open event stream.", func() float64 {
+		return float64(stateManager.ActiveClientCount())
+	})
+	metrics.GaugeVecFunc("yamanaka_missed_events", "Events queued for a device that is not connected.", "device", func() map[string]float64 {
+		backlog := make(map[string]float64)
+		for device, count := range state.MissedEventCounts(vaultPath) {
+			backlog[device] = float64(count)
+		}
+		return backlog
+	})
+	metrics.GaugeFunc("yamanaka_vault_files", "Files in the vault.", func() float64 {
+		files, _ := vaultStats()
+		return float64(files)
+	})
+	metrics.GaugeFunc("yamanaka_vault_size_bytes", "Total size of the files in the vault.", func() float64 {
+		_, size := vaultStats()
+		return float64(size)
+	})
+}
+
+// loads the configured certificate or the self-signed one and logs the fingerprints to pin
+func serverTLS(cfg *config.Config) (*tls.Config, error) {
+	certPath := cfg.TLSCert
+	var reloader *certs.Reloader
+	var err error
+	if cfg.TLSSelfSigned {
+		var selfSigned certs.SelfSigned
+		reloader, selfSigned, err = certs.NewSelfSignedReloader(cfg.TLSDir, certs.DefaultHosts(cfg.TLSHosts))
+		if err != nil {
+			return nil, err
+		}
+		certPath = selfSigned.ServerCert
+		slog.Info("tls: self-signed CA, trust or pin it on your devices", "ca", selfSigned.CACert, "sha256", certs.Fingerprint(selfSigned.CA))
+	} else {
+		reloader, err = certs.NewReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
 	}
+	slog.Info("tls: serving certificate", "cert", certPath, "sha256", certs.Fingerprint(reloader.Leaf()))
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// rejects requests whose device_id could not be used as a file name, before any handler sees it
+func deviceIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.URL.Query().Get("device_id"); id != "" && !state.ValidDeviceID(id) {
+			http.Error(w, "device_id must be 1 to 64 letters, digits, '-' or '_'", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejects new pushes and event streams with 503 while the server is shutting down,
+// reads are still served until the listener is closed
+func drainMiddleware(next http.Handler, draining *atomic.Bool, retryAfter time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() && (r.Method == http.MethodPost || r.URL.Path == "/api/events" || r.URL.Path == "/api/ws") {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // wraps an http.Handler with CORS headers
-func corsMiddleware(next http.Handler) http.Handler {
+func corsMiddleware(next http.Handler, origin string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "app://obsidian.md")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, Origin, Accept, Authorization")
 		if r.Method == http.MethodOptions {
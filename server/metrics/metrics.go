@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	defaultRegistry = &registry{}
+)
+
+// metrics updated across the server, exposed in Prometheus text format by Handler
+var (
+	PushRequests   = NewCounter("yamanaka_push_requests_total", "Push requests handled, by result.", "result")
+	PushFiles      = NewCounter("yamanaka_push_files_total", "Files changed by pushes, by action.", "action")
+	PushBytes      = NewCounter("yamanaka_push_bytes_total", "Decoded bytes of files written by pushes.")
+	PushDuration   = NewHistogram("yamanaka_push_duration_seconds", "Time to handle a push request.", DefaultBuckets)
+	Commits        = NewCounter("yamanaka_commits_total", "Git commits attempted, by result.", "result")
+	CommitDuration = NewHistogram("yamanaka_commit_duration_seconds", "Time to stage and commit the vault.", DefaultBuckets)
+	EventsSent     = NewCounter("yamanaka_sse_events_sent_total", "Events written to SSE and WebSocket streams, by event.", "event")
+	BroadcastFull  = NewCounter("yamanaka_broadcast_channel_full_total", "Broadcasts that found the queue of a connected client full and disconnected it.")
+	StoredMissed   = NewCounter("yamanaka_missed_events_stored_total", "Events stored for clients that were not reachable.")
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+func (r *registry) add(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Counter is a monotonically increasing value, optionally split by one label.
+type Counter struct {
+	name   string
+	help   string
+	label  string
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// creates and registers a counter, label is empty for a counter without labels
+func NewCounter(name, help string, label ...string) *Counter {
+	c := &Counter{name: name, help: help, values: make(map[string]float64)}
+	if len(label) > 0 {
+		c.label = label[0]
+	}
+	defaultRegistry.add(c)
+	return c
+}
+
+// adds one, labelValue is ignored by counters without a label
+func (c *Counter) Inc(labelValue ...string) {
+	c.Add(1, labelValue...)
+}
+
+func (c *Counter) Add(delta float64, labelValue ...string) {
+	key := ""
+	if c.label != "" && len(labelValue) > 0 {
+		key = labelValue[0]
+	}
+	c.mutex.Lock()
+	c.values[key] += delta
+	c.mutex.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, labelPair(c.label, key), formatValue(c.values[key]))
+	}
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mutex   sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// creates and registers a histogram with the given upper bounds (sorted ascending)
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	defaultRegistry.add(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// observes the time passed since start, in seconds
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// gaugeFunc reads its values when scraped
+type gaugeFunc struct {
+	name  string
+	help  string
+	label string
+	read  func() map[string]float64
+}
+
+// registers a gauge computed on every scrape
+func GaugeFunc(name, help string, read func() float64) {
+	defaultRegistry.add(&gaugeFunc{name: name, help: help, read: func() map[string]float64 {
+		return map[string]float64{"": read()}
+	}})
+}
+
+// registers a gauge with one label computed on every scrape, read returns a value per label value
+func GaugeVecFunc(name, help, label string, read func() map[string]float64) {
+	defaultRegistry.add(&gaugeFunc{name: name, help: help, label: label, read: read})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	values := g.read()
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedKeys(values) {
+		if g.label == "" {
+			fmt.Fprintf(w, "%s %s\n", g.name, formatValue(values[key]))
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", g.name, labelPair(g.label, key), formatValue(values[key]))
+		}
+	}
+}
+
+// Handler serves every registered metric in the Prometheus text exposition format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defaultRegistry.mutex.Lock()
+	collectors := append([]collector(nil), defaultRegistry.collectors...)
+	defaultRegistry.mutex.Unlock()
+
+	var out strings.Builder
+	for _, c := range collectors {
+		c.write(&out)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := io.WriteString(w, out.String()); err != nil {
+		slog.Warn("metrics: could not write response", "error", err)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func labelPair(label, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+	return label + `="` + value + `"`
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
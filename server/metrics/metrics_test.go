@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerOutput(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Requests, by result.", "result")
+	counter.Inc("ok")
+	counter.Add(2, "ok")
+	counter.Inc(`bad "quote"`)
+	plain := NewCounter("test_plain_total", "A counter without labels.")
+	plain.Inc("ignored")
+	histogram := NewHistogram("test_duration_seconds", "Durations.", []float64{.1, 1})
+	histogram.Observe(.05)
+	histogram.Observe(.5)
+	histogram.Observe(3)
+	GaugeFunc("test_queue_length", "Queue length.", func() float64 { return 7 })
+	GaugeVecFunc("test_devices", "Devices, by state.", "state", func() map[string]float64 {
+		return map[string]float64{"online": 2, "dormant": 1}
+	})
+
+	recorder := httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := recorder.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	body := recorder.Body.String()
+	want := []string{
+		"# HELP test_requests_total Requests, by result.\n# TYPE test_requests_total counter\n" +
+			"test_requests_total{result=\"bad \\\"quote\\\"\"} 1\ntest_requests_total{result=\"ok\"} 3\n",
+		"# TYPE test_plain_total counter\ntest_plain_total 1\n",
+		"# TYPE test_duration_seconds histogram\n" +
+			"test_duration_seconds_bucket{le=\"0.1\"} 1\n" +
+			"test_duration_seconds_bucket{le=\"1\"} 2\n" +
+			"test_duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"test_duration_seconds_sum 3.55\n" +
+			"test_duration_seconds_count 3\n",
+		"# TYPE test_queue_length gauge\ntest_queue_length 7\n",
+		"# TYPE test_devices gauge\ntest_devices{state=\"dormant\"} 1\ntest_devices{state=\"online\"} 2\n",
+	}
+	for _, block := range want {
+		if !strings.Contains(body, block) {
+			t.Errorf("output lacks\n%s\ngot\n%s", block, body)
+		}
+	}
+	// the server metrics are registered even before anything happened
+	if !strings.Contains(body, "# TYPE yamanaka_push_requests_total counter\n") {
+		t.Errorf("output lacks the server metrics")
+	}
+
+	recorder = httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /metrics = %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,206 @@
+package state
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/events"
+)
+
+// Session describes the open event stream of a device.
+type Session struct {
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// DeviceMetadata is what a device reports about itself when it connects; empty fields keep the stored value.
+type DeviceMetadata struct {
+	Name          string
+	Platform      string
+	PluginVersion string
+}
+
+func (d DeviceMetadata) apply(record *DeviceRecord) {
+	if d.Name != "" {
+		record.Name = d.Name
+	}
+	if d.Platform != "" {
+		record.Platform = d.Platform
+	}
+	if d.PluginVersion != "" {
+		record.PluginVersion = d.PluginVersion
+	}
+}
+
+// DeviceInfo is what the server knows about one tracked device.
+type DeviceInfo struct {
+	DeviceID string `json:"device_id"`
+	DeviceRecord
+	Online        bool      `json:"online"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at,omitzero"`
+	PendingEvents int       `json:"pending_events"`
+}
+
+// how often activity outside the event stream is written to clients.json
+const touchSaveInterval = time.Minute
+
+// records activity of a tracked device outside its event stream, e.g. a push
+func (m *Manager) Touch(deviceID, remoteAddr string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	record, ok := m.trackedClients[deviceID]
+	if !ok {
+		return
+	}
+	record.LastSeen = time.Now().UTC()
+	record.LastIP = remoteIP(remoteAddr)
+	if time.Since(m.lastSave) > touchSaveInterval {
+		m.saveLocked()
+	}
+}
+
+// records that a device received every queued event up to seq and drops those events from its queue
+func (m *Manager) Ack(deviceID string, seq int64) int {
+	if seq <= 0 {
+		return 0
+	}
+	m.mutex.Lock()
+	if record, ok := m.trackedClients[deviceID]; ok && seq > record.LastAck {
+		record.LastAck = seq
+		if time.Since(m.lastSave) > touchSaveInterval {
+			m.saveLocked()
+		}
+	}
+	m.mutex.Unlock()
+	return AckMissedEvents(m.dataDir, deviceID, seq)
+}
+
+// lists every tracked device, sorted by name and then device ID
+func (m *Manager) Devices() []DeviceInfo {
+	pending := MissedEventCounts(m.dataDir)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	devices := make([]DeviceInfo, 0, len(m.trackedClients))
+	for id, record := range m.trackedClients {
+		session, online := m.sessions[id]
+		devices = append(devices, DeviceInfo{
+			DeviceID:      id,
+			DeviceRecord:  *record,
+			Online:        online,
+			RemoteAddr:    session.RemoteAddr,
+			ConnectedAt:   session.ConnectedAt,
+			PendingEvents: pending[id],
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Name != devices[j].Name {
+			return devices[i].Name < devices[j].Name
+		}
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices
+}
+
+// reports whether the device is tracked
+func (m *Manager) HasDevice(deviceID string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.trackedClients[deviceID]
+	return ok
+}
+
+// ends the event stream of a device, returns false if it was not connected
+// the device is free to reconnect and keeps receiving events meanwhile through its backlog
+func (m *Manager) Disconnect(deviceID string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sub, ok := m.clients[deviceID]
+	if !ok {
+		return false
+	}
+	sub.end(disconnected(DisconnectAdmin, "The event stream was ended by an administrator."))
+	m.endLocked(deviceID)
+	return true
+}
+
+// forgets a device: ends its stream, drops its backlog and removes it from the tracked clients
+// returns false if the device was unknown
+func (m *Manager) RemoveDevice(deviceID string) (bool, error) {
+	m.mutex.Lock()
+	if sub, connected := m.clients[deviceID]; connected {
+		sub.end(disconnected(DisconnectAdmin, "The device was removed by an administrator."))
+		delete(m.clients, deviceID)
+		delete(m.sessions, deviceID)
+	}
+	_, known := m.trackedClients[deviceID]
+	if known {
+		delete(m.trackedClients, deviceID)
+		m.saveLocked()
+	}
+	m.mutex.Unlock()
+
+	if !known {
+		return false, nil
+	}
+	return true, ClearMissedEvents(m.dataDir, deviceID)
+}
+
+// marks devices that were not seen for ttl as dormant and returns their IDs
+// a dormant device collects no events; its backlog is replaced by a single full sync, which it receives when it is back
+func (m *Manager) MarkDormant(ttl time.Duration) []string {
+	m.mutex.Lock()
+	now := time.Now().UTC()
+	var dormant []string
+	for id, record := range m.trackedClients {
+		if _, online := m.clients[id]; online || record.IsDormant() {
+			continue
+		}
+		lastSeen := record.LastSeen
+		if lastSeen.IsZero() {
+			lastSeen = m.startedAt
+		}
+		if now.Sub(lastSeen) > ttl {
+			record.DormantSince = now
+			dormant = append(dormant, id)
+		}
+	}
+	if len(dormant) > 0 {
+		m.saveLocked()
+	}
+	m.mutex.Unlock()
+
+	// Broadcast skips dormant devices from here on, so the backlog can be replaced without the lock
+	for _, id := range dormant {
+		if err := ClearMissedEvents(m.dataDir, id); err != nil {
+			slog.Error("could not drop backlog of dormant device", "client", id, "error", err)
+		}
+		StoreMissedEvent(m.dataDir, id, events.FullSyncEventData{
+			Message: "This device was inactive for too long and stopped receiving updates. A full sync is required.",
+		})
+	}
+	return dormant
+}
+
+// host part of a request's remote address
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// ClearMissedEvents discards every queued event of a client.
+func ClearMissedEvents(dataDir string, clientID string) error {
+	clientDir, err := missedEventsDir(dataDir, clientID)
+	if err != nil {
+		return err
+	}
+	missedMutex.Lock()
+	defer missedMutex.Unlock()
+	writeQueuedLocked()
+	return os.RemoveAll(clientDir)
+}
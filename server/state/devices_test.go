@@ -0,0 +1,117 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/events"
+)
+
+func TestValidDeviceID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"3f0c2a4e-1b2c-4d5e-8f90-123456789abc", true},
+		{"laptop_1", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"../vault", false},
+		{"name with space", false},
+		{string(make([]byte, 65)), false},
+	}
+	for _, tt := range tests {
+		if got := ValidDeviceID(tt.id); got != tt.want {
+			t.Errorf("ValidDeviceID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestClearMissedEventsRejectsUnsafeIDs(t *testing.T) {
+	dataDir := t.TempDir()
+	keep := []string{
+		filepath.Join(dataDir, "note.md"),
+		filepath.Join(dataDir, MissedEventsDir, "other", "a.json"),
+	}
+	for _, path := range keep {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"..", ".", "", "../..", "other/.."} {
+		if err := ClearMissedEvents(dataDir, id); !errors.Is(err, ErrInvalidDeviceID) {
+			t.Errorf("ClearMissedEvents(%q) = %v, want ErrInvalidDeviceID", id, err)
+		}
+	}
+	for _, path := range keep {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+
+	if err := ClearMissedEvents(dataDir, "other"); err != nil {
+		t.Fatalf("ClearMissedEvents(other): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, MissedEventsDir, "other")); !os.IsNotExist(err) {
+		t.Errorf("backlog of other still exists: %v", err)
+	}
+}
+
+func TestMarkDormant(t *testing.T) {
+	dataDir := t.TempDir()
+	m := NewManager(dataDir)
+	t.Cleanup(func() { m.Shutdown(events.ServerShutdownEventData{}) })
+	for _, id := range []string{"laptop", "phone", "tablet"} {
+		m.RemoveClient(id, m.AddClient(id, "192.0.2.1:1234", DeviceMetadata{}))
+	}
+	m.AddClient("tablet", "192.0.2.1:1234", DeviceMetadata{}) // online devices never go dormant
+	m.mutex.Lock()
+	for _, id := range []string{"laptop", "tablet"} {
+		m.trackedClients[id].LastSeen = time.Now().Add(-2 * time.Hour)
+	}
+	m.mutex.Unlock()
+	m.Broadcast("phone", update("a.md"))
+
+	if dormant := m.MarkDormant(time.Hour); !slices.Equal(dormant, []string{"laptop"}) {
+		t.Fatalf("MarkDormant() = %v, want only the laptop", dormant)
+	}
+	if dormant := m.MarkDormant(time.Hour); len(dormant) != 0 {
+		t.Errorf("second MarkDormant() = %v, want nothing new", dormant)
+	}
+	// the backlog is replaced by a full sync and nothing more is queued
+	m.Broadcast("phone", update("b.md"))
+	if got := pendingSummary(dataDir, "laptop"); !slices.Equal(got, []string{"full_sync "}) {
+		t.Errorf("laptop pending = %q, want a single full sync", got)
+	}
+	for _, device := range m.Devices() {
+		if dormant := device.DeviceID == "laptop"; device.IsDormant() != dormant {
+			t.Errorf("%s: dormant since %v", device.DeviceID, device.DormantSince)
+		}
+	}
+
+	// back online it is active again and gets events
+	m.AddClient("laptop", "192.0.2.1:1234", DeviceMetadata{})
+	m.Broadcast("phone", update("c.md"))
+	if got := pendingSummary(dataDir, "laptop"); !slices.Equal(got, []string{"full_sync "}) {
+		t.Errorf("laptop pending = %q, want the full sync to stay in front", got)
+	}
+	for _, device := range m.Devices() {
+		if device.IsDormant() {
+			t.Errorf("%s is still dormant", device.DeviceID)
+		}
+	}
+	if got := pendingSummary(dataDir, "tablet"); !slices.Equal(got, []string{"update a.md", "update b.md", "update c.md"}) {
+		t.Errorf("tablet pending = %q, want every update", got)
+	}
+}
@@ -2,60 +2,125 @@ package state
 
 import (
 	"log/slog"
-	"maps"
 	"sync"
+	"time"
 
 	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/metrics"
 )
 
 // holds the state of all connected clients for SSE
 type Manager struct {
-	clients        map[string]chan any // any accommodates different event types
-	trackedClients map[string]bool
+	clients        map[string]*Subscription
+	sessions       map[string]Session // details of the open event stream of each client
+	trackedClients map[string]*DeviceRecord
 	mutex          sync.RWMutex
 	dataDir        string
+
+	saveMutex  sync.Mutex // serializes writes of clients.json
+	saveGen    uint64     // bumped under mutex for every save
+	writtenGen uint64     // newest generation on disk, under saveMutex
+	lastSave   time.Time
+	startedAt  time.Time // stands in for the last seen time of devices that never had one
+
+	QueueSize int // events a connected client may fall behind before it is disconnected
 }
 
 var FileSystemMutex = &sync.RWMutex{}
 
+// Sequenced is a queued event sent to a connected client, with the sequence the client acknowledges it by.
+type Sequenced struct {
+	Seq   int64
+	Event any
+}
+
 // creates a new state manager
 func NewManager(dataDir string) *Manager {
 	m := &Manager{
-		clients:        make(map[string]chan any),
-		trackedClients: make(map[string]bool),
+		clients:        make(map[string]*Subscription),
+		sessions:       make(map[string]Session),
+		trackedClients: LoadTrackedClients(dataDir),
 		dataDir:        dataDir,
+		startedAt:      time.Now().UTC(),
+		QueueSize:      DefaultQueueSize,
 	}
-	m.trackedClients = LoadTrackedClients(m.dataDir, &m.mutex)
 	return m
 }
 
-// registers a new client with its message channel
-func (m *Manager) AddClient(deviceID string, ch chan any) {
+// registers a new client session, records the metadata it reported and returns the session's event queue
+// an older stream of the same device is ended
+func (m *Manager) AddClient(deviceID string, remoteAddr string, metadata DeviceMetadata) *Subscription {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	m.clients[deviceID] = ch
-	if !m.trackedClients[deviceID] {
-		m.trackedClients[deviceID] = true
-		clientsToSave := make(map[string]bool)
-		maps.Copy(clientsToSave, m.trackedClients) // use copy to avoid holding lock in goroutine
-		go SaveTrackedClients(m.dataDir, clientsToSave, &sync.RWMutex{})
+	if old, ok := m.clients[deviceID]; ok {
+		old.end(disconnected(DisconnectReplaced, "A newer connection of this device took over the event stream."))
+	}
+	sub := newSubscription(m.QueueSize)
+	m.clients[deviceID] = sub
+	now := time.Now().UTC()
+	m.sessions[deviceID] = Session{RemoteAddr: remoteAddr, ConnectedAt: now}
+	record, ok := m.trackedClients[deviceID]
+	if !ok {
+		record = &DeviceRecord{FirstSeen: now}
+		m.trackedClients[deviceID] = record
 	}
+	metadata.apply(record)
+	if record.IsDormant() {
+		// its backlog is the full sync queued when it went dormant
+		slog.Info("dormant device is back", "client", deviceID, "dormant since", record.DormantSince)
+		record.DormantSince = time.Time{}
+	}
+	record.LastSeen = now
+	record.LastIP = remoteIP(remoteAddr)
+	m.saveLocked()
+	return sub
 }
 
-// unregisters a client
-func (m *Manager) RemoveClient(deviceID string) {
+// unregisters a client, unless sub was already replaced by a newer stream of the same device
+func (m *Manager) RemoveClient(deviceID string, sub *Subscription) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if ch, ok := m.clients[deviceID]; ok {
-		close(ch)
-		delete(m.clients, deviceID)
+	sub.end(nil)
+	if current, ok := m.clients[deviceID]; ok && current == sub {
+		m.endLocked(deviceID)
+	}
+}
+
+// forgets the session of a connected client, the caller holds mutex and has ended the subscription
+func (m *Manager) endLocked(deviceID string) {
+	delete(m.clients, deviceID)
+	delete(m.sessions, deviceID)
+	if record, ok := m.trackedClients[deviceID]; ok {
+		record.LastSeen = time.Now().UTC()
+		m.saveLocked()
 	}
 }
 
+// writes the tracked clients in the background, the caller holds mutex
+// saves finishing out of order never replace a newer file with an older copy
+func (m *Manager) saveLocked() {
+	m.saveGen++
+	gen := m.saveGen
+	records := copyRecords(m.trackedClients)
+	m.lastSave = time.Now()
+	go m.save(gen, records)
+}
+
+func (m *Manager) save(gen uint64, records map[string]DeviceRecord) {
+	m.saveMutex.Lock()
+	defer m.saveMutex.Unlock()
+	if gen < m.writtenGen {
+		return
+	}
+	m.writtenGen = gen
+	SaveTrackedClients(m.dataDir, records)
+}
+
 // sends an event to all clients except the sender.
+// Every event but a commit notice is queued for each client first and stays queued until the client acknowledges it,
+// so an event lost with a dropped connection is sent again when the client reconnects.
+// It never waits for a client: one whose queue is full is disconnected and catches up from its backlog.
 func (m *Manager) Broadcast(senderDeviceID string, eventData any) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
 	var eventType string
 	var targetPath string
 	switch data := eventData.(type) {
@@ -64,25 +129,73 @@ func (m *Manager) Broadcast(senderDeviceID string, eventData any) {
 		targetPath = data.Path
 	case events.FullSyncEventData:
 		eventType = "FullSyncEventData"
+	case events.CommitEventData:
+		eventType = "CommitEventData"
 	default:
 		eventType = "UnknownEvent"
 	}
 	slog.Info("broadcast", "event", eventType, "path", targetPath, "sender", senderDeviceID)
+	_, ephemeral := eventData.(events.CommitEventData) // only useful to connected clients, never stored
 
-	allClients := m.GetAllTrackedClients()
-	for _, clientID := range allClients {
-		if clientID == senderDeviceID {
-			continue
+	m.mutex.RLock()
+	// read lock is not reentrant once a writer waits, so nothing in this block may take it again
+	var recipients []string
+	for clientID, record := range m.trackedClients {
+		if clientID != senderDeviceID && !record.IsDormant() {
+			recipients = append(recipients, clientID)
 		}
-		if m.IsClientActive(clientID) {
-			select {
-			case m.clients[clientID] <- eventData:
-			default:
-				slog.Warn("channel is full, skipping broadcast", "client", clientID, "event", eventType)
-				StoreMissedEvent(m.dataDir, clientID, eventData)
-			}
-		} else {
-			StoreMissedEvent(m.dataDir, clientID, eventData)
+	}
+	message := eventData
+	if !ephemeral {
+		// written to disk in the background, the broadcast does not wait for it
+		message = Sequenced{Seq: QueueMissedEvent(m.dataDir, recipients, eventData), Event: eventData}
+	}
+	slow := make(map[string]*Subscription)
+	for _, clientID := range recipients {
+		if sub, ok := m.clients[clientID]; ok && !sub.offer(message) {
+			// the event stays queued on disk, the client gets it when it reconnects
+			slog.Warn("client queue is full, disconnecting slow client", "client", clientID, "event", eventType, "queue size", cap(sub.events))
+			metrics.BroadcastFull.Inc()
+			slow[clientID] = sub
 		}
 	}
+	m.mutex.RUnlock()
+	for clientID, sub := range slow {
+		m.dropSlow(clientID, sub)
+	}
+}
+
+// ends the session of a client that did not keep up with its queue
+func (m *Manager) dropSlow(clientID string, sub *Subscription) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sub.end(disconnected(DisconnectSlowConsumer, "The connection fell too far behind. Reconnect to resume from the last acknowledged event."))
+	if current, ok := m.clients[clientID]; ok && current == sub {
+		m.endLocked(clientID)
+	}
+}
+
+// ends every session with a server_shutdown event and saves the tracked clients
+func (m *Manager) Shutdown(event events.ServerShutdownEventData) {
+	m.mutex.Lock()
+	for clientID, sub := range m.clients {
+		sub.end(event)
+		delete(m.clients, clientID)
+		delete(m.sessions, clientID)
+		if record, ok := m.trackedClients[clientID]; ok {
+			record.LastSeen = time.Now().UTC()
+		}
+	}
+	m.saveGen++
+	gen := m.saveGen
+	records := copyRecords(m.trackedClients)
+	m.mutex.Unlock()
+	m.save(gen, records)
+}
+
+// number of clients with an open event stream
+func (m *Manager) ActiveClientCount() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.clients)
 }
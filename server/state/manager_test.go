@@ -0,0 +1,55 @@
+package state
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/tanq16/yamanaka/server/events"
+)
+
+func TestBroadcastDisconnectsSlowClient(t *testing.T) {
+	dataDir := t.TempDir()
+	m := NewManager(dataDir)
+	t.Cleanup(func() { m.Shutdown(events.ServerShutdownEventData{}) })
+	m.QueueSize = 2
+	slow := m.AddClient("laptop", "192.0.2.1:1234", DeviceMetadata{})
+	fast := m.AddClient("phone", "192.0.2.2:1234", DeviceMetadata{})
+
+	for _, relPath := range []string{"a.md", "b.md", "c.md"} {
+		m.Broadcast("tablet", update(relPath))
+		<-fast.Events() // the phone keeps up
+	}
+
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatal("the slow client is still connected")
+	}
+	if final, ok := slow.Final().(events.DisconnectedEventData); !ok || final.Reason != DisconnectSlowConsumer {
+		t.Errorf("final event = %+v, want a slow_consumer disconnect", slow.Final())
+	}
+	if m.IsClientActive("laptop") || !m.IsClientActive("phone") {
+		t.Errorf("active: laptop %v, phone %v, want only the phone", m.IsClientActive("laptop"), m.IsClientActive("phone"))
+	}
+	select {
+	case <-fast.Done():
+		t.Error("the phone was disconnected")
+	default:
+	}
+	// nothing is lost, the laptop catches up from its backlog when it reconnects
+	if got := pendingSummary(dataDir, "laptop"); !slices.Equal(got, []string{"update a.md", "update b.md", "update c.md"}) {
+		t.Errorf("laptop pending = %q, want every update", got)
+	}
+
+	// a new stream of the same device ends the old one
+	again := m.AddClient("laptop", "192.0.2.1:1234", DeviceMetadata{})
+	newer := m.AddClient("laptop", "192.0.2.1:1234", DeviceMetadata{})
+	if final, ok := again.Final().(events.DisconnectedEventData); !ok || final.Reason != DisconnectReplaced {
+		t.Errorf("final event = %+v, want a replaced disconnect", again.Final())
+	}
+	m.RemoveClient("laptop", again) // the old stream going away leaves the newer one registered
+	if !m.IsClientActive("laptop") {
+		t.Error("removing the replaced stream ended the newer one")
+	}
+	m.RemoveClient("laptop", newer)
+}
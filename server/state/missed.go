@@ -1,88 +1,397 @@
 package state
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/tanq16/yamanaka/server/events"
+	"github.com/tanq16/yamanaka/server/metrics"
 )
 
-const missedEventsDir = "missed_events"
+// MissedEventsDir is the directory (inside the data dir) holding queued events per client.
+const MissedEventsDir = "missed_events"
 
-// StoreMissedEvent saves an event for a specific client who is not currently connected.
-func StoreMissedEvent(dataDir string, clientID string, eventData interface{}) {
-	clientDir := filepath.Join(dataDir, missedEventsDir, clientID)
-	if err := os.MkdirAll(clientDir, 0755); err != nil {
-		log.Printf("ERROR: Could not create directory for missed events for client %s: %v", clientID, err)
-		return
+// missed event actions
+const (
+	MissedUpdate   = "update"    // the file was created or changed, its content is read from the vault on delivery
+	MissedDelete   = "delete"    // the file was deleted
+	MissedFullSync = "full_sync" // the client has to pull the whole vault
+)
+
+// fullSyncFile holds a queued full sync; every other file in a client's directory is the latest event of one path
+const fullSyncFile = "full_sync.json"
+
+// MissedEvent is the latest queued state of one path, or a queued full sync.
+type MissedEvent struct {
+	Seq     int64  `json:"seq"` // orders events, later events win
+	Action  string `json:"action"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message,omitempty"` // reason of a full sync
+}
+
+// ErrInvalidDeviceID is returned for device IDs that are not safe to use as a file name.
+var ErrInvalidDeviceID = errors.New("invalid device ID")
+
+// device IDs name directories of the missed events store, so anything like "." or ".." is refused
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidDeviceID reports whether id is an acceptable device ID: 1 to 64 letters, digits, '-' or '_'.
+func ValidDeviceID(id string) bool {
+	return deviceIDPattern.MatchString(id)
+}
+
+// directory of a client's queue, the only way paths of the store are built from a device ID
+func missedEventsDir(dataDir, clientID string) (string, error) {
+	if !ValidDeviceID(clientID) {
+		return "", ErrInvalidDeviceID
 	}
+	return filepath.Join(dataDir, MissedEventsDir, clientID), nil
+}
 
-	// Filename based on timestamp to ensure order
-	timestamp := time.Now().UnixNano()
-	fileName := fmt.Sprintf("%d.json", timestamp)
-	filePath := filepath.Join(clientDir, fileName)
+// serializes writes and reads of the missed events store
+var missedMutex sync.Mutex
 
-	data, err := json.Marshal(eventData)
-	if err != nil {
-		log.Printf("ERROR: Could not marshal missed event for client %s: %v", clientID, err)
-		return
+// the last sequence handed out, sequences only grow even if the clock goes back
+var lastSeq atomic.Int64
+
+// NextSeq returns a new event sequence, larger than every sequence returned before.
+func NextSeq() int64 {
+	for {
+		last := lastSeq.Load()
+		next := max(time.Now().UnixNano(), last+1)
+		if lastSeq.CompareAndSwap(last, next) {
+			return next
+		}
 	}
+}
 
-	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
-		log.Printf("ERROR: Could not write missed event to file for client %s: %v", clientID, err)
+// StoreMissedEvent queues an event for a client until the client acknowledges it, and returns its sequence.
+// The queue keeps only the latest state per path: a later update or delete replaces whatever was queued
+// for that path before, so a rename (a delete and an update) chains correctly. Contents are not stored.
+// A full sync replaces the whole queue, and nothing more is queued while a full sync is pending.
+func StoreMissedEvent(dataDir string, clientID string, eventData interface{}) int64 {
+	event, ok := newMissedEvent(clientID, eventData)
+	missedMutex.Lock()
+	defer missedMutex.Unlock()
+	writeQueuedLocked()
+	event.Seq = NextSeq()
+	if ok {
+		storeLocked(dataDir, clientID, event)
 	}
+	return event.Seq
 }
 
-// RetrieveAndClearMissedEvents gets all stored events for a client and then clears them.
-func RetrieveAndClearMissedEvents(dataDir string, clientID string) []interface{} {
-	clientDir := filepath.Join(dataDir, missedEventsDir, clientID)
-	if _, err := os.Stat(clientDir); os.IsNotExist(err) {
-		return nil // No missed events
+// QueueMissedEvent is StoreMissedEvent for several clients, without waiting for the disk.
+// A background goroutine writes the event; every read of the store writes whatever is still queued first.
+func QueueMissedEvent(dataDir string, clientIDs []string, eventData interface{}) int64 {
+	event, ok := newMissedEvent(strings.Join(clientIDs, ","), eventData)
+	queuedMutex.Lock()
+	// sequences are taken under the lock so the queue stays in sequence order
+	event.Seq = NextSeq()
+	if ok && len(clientIDs) > 0 {
+		queuedWrites = append(queuedWrites, queuedWrite{dataDir: dataDir, clientIDs: clientIDs, event: event})
+	}
+	queuedMutex.Unlock()
+	storeOnce.Do(func() { go storeQueued() })
+	select {
+	case storeWake <- struct{}{}:
+	default:
 	}
+	return event.Seq
+}
 
-	files, err := ioutil.ReadDir(clientDir)
+// FlushMissedEvents writes every queued event to disk, used on shutdown.
+func FlushMissedEvents() {
+	missedMutex.Lock()
+	defer missedMutex.Unlock()
+	writeQueuedLocked()
+}
+
+// an event waiting to be written for some clients
+type queuedWrite struct {
+	dataDir   string
+	clientIDs []string
+	event     MissedEvent
+}
+
+var (
+	queuedMutex  sync.Mutex
+	queuedWrites []queuedWrite
+	storeWake    = make(chan struct{}, 1)
+	storeOnce    sync.Once
+)
+
+func storeQueued() {
+	for range storeWake {
+		FlushMissedEvents()
+	}
+}
+
+// writes the queued events in sequence order, caller must hold missedMutex
+func writeQueuedLocked() {
+	queuedMutex.Lock()
+	writes := queuedWrites
+	queuedWrites = nil
+	queuedMutex.Unlock()
+	for _, write := range writes {
+		for _, clientID := range write.clientIDs {
+			storeLocked(write.dataDir, clientID, write.event)
+		}
+	}
+}
+
+// the stored form of an event, without its sequence; ok is false for events that are never stored
+func newMissedEvent(clientID string, eventData interface{}) (MissedEvent, bool) {
+	var event MissedEvent
+	switch data := eventData.(type) {
+	case events.FileEventData:
+		event.Path = data.Path
+		event.Action = MissedDelete
+		if data.Content != "" {
+			event.Action = MissedUpdate
+		}
+	case events.FullSyncEventData:
+		event.Action = MissedFullSync
+		event.Message = data.Message
+	default:
+		log.Printf("ERROR: Cannot queue missed event of type %T for client %s", eventData, clientID)
+		return event, false
+	}
+	return event, true
+}
+
+// writes one event to a client's queue, caller must hold missedMutex
+func storeLocked(dataDir, clientID string, event MissedEvent) {
+	clientDir, err := missedEventsDir(dataDir, clientID)
+	if err != nil {
+		log.Printf("ERROR: Not queueing event for client %q: %v", clientID, err)
+		return
+	}
+	if event.Action == MissedFullSync {
+		if err := os.RemoveAll(clientDir); err != nil {
+			log.Printf("ERROR: Could not clear missed events for client %s: %v", clientID, err)
+		}
+	} else if _, err := os.Stat(filepath.Join(clientDir, fullSyncFile)); err == nil {
+		return // the pending full sync covers this change
+	}
+	if err := os.MkdirAll(clientDir, 0755); err != nil {
+		log.Printf("ERROR: Could not create directory for missed events for client %s: %v", clientID, err)
+		return
+	}
+	if err := writeMissedEvent(clientDir, event); err != nil {
+		log.Printf("ERROR: Could not write missed event to file for client %s: %v", clientID, err)
+		return
+	}
+	metrics.StoredMissed.Inc()
+}
+
+// PendingMissedEvents returns the events a client has not acknowledged yet, oldest first.
+func PendingMissedEvents(dataDir string, clientID string) []MissedEvent {
+	clientDir, err := missedEventsDir(dataDir, clientID)
 	if err != nil {
-		log.Printf("ERROR: Could not read missed events directory for client %s: %v", clientID, err)
 		return nil
 	}
+	missedMutex.Lock()
+	defer missedMutex.Unlock()
+	writeQueuedLocked()
+	return readMissedEvents(clientDir, clientID)
+}
 
-	// Sort files by timestamp in the filename to ensure chronological order
-	sort.Slice(files, func(i, j int) bool {
-		ts1, _ := strconv.ParseInt(strings.TrimSuffix(files[i].Name(), ".json"), 10, 64)
-		ts2, _ := strconv.ParseInt(strings.TrimSuffix(files[j].Name(), ".json"), 10, 64)
-		return ts1 < ts2
-	})
+// AckMissedEvents removes the queued events of a client up to and including seq and returns how many were removed.
+// An event that was replaced by a newer one for the same path stays until the newer one is acknowledged.
+func AckMissedEvents(dataDir string, clientID string, seq int64) int {
+	clientDir, err := missedEventsDir(dataDir, clientID)
+	if err != nil {
+		return 0
+	}
+	missedMutex.Lock()
+	defer missedMutex.Unlock()
+	writeQueuedLocked() // an event acknowledged while still queued must not be written afterwards
+	files, err := os.ReadDir(clientDir)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(clientDir, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		event, err := decodeMissedEvent(data, file.Name())
+		if err != nil || event.Seq > seq {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("ERROR: Could not remove acknowledged event %s for client %s: %v", file.Name(), clientID, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
 
-	var events []interface{}
+// reads a client's queue, oldest first
+// files written before the queue was compacted by path ("<nanos>.json" with the content embedded) are
+// converted and compacted on the fly
+func readMissedEvents(clientDir, clientID string) []MissedEvent {
+	files, err := os.ReadDir(clientDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: Could not read missed events directory for client %s: %v", clientID, err)
+		}
+		return nil
+	}
+	latest := make(map[string]MissedEvent) // by path, "" for a full sync
 	for _, file := range files {
-		filePath := filepath.Join(clientDir, file.Name())
-		data, err := ioutil.ReadFile(filePath)
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(clientDir, file.Name()))
 		if err != nil {
 			log.Printf("ERROR: Could not read missed event file %s for client %s: %v", file.Name(), clientID, err)
 			continue
 		}
-
-		var eventData interface{}
-		if err := json.Unmarshal(data, &eventData); err != nil {
+		event, err := decodeMissedEvent(data, file.Name())
+		if err != nil {
 			log.Printf("ERROR: Could not unmarshal missed event file %s for client %s: %v", file.Name(), clientID, err)
 			continue
 		}
-		events = append(events, eventData)
+		if previous, ok := latest[event.Path]; !ok || event.Seq > previous.Seq {
+			latest[event.Path] = event
+		}
+	}
+
+	queued := make([]MissedEvent, 0, len(latest))
+	if fullSync, ok := latest[""]; ok {
+		// everything queued before the full sync is covered by it
+		for _, event := range latest {
+			if event.Seq >= fullSync.Seq {
+				queued = append(queued, event)
+			}
+		}
+	} else {
+		for _, event := range latest {
+			queued = append(queued, event)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].Seq < queued[j].Seq })
+	return queued
+}
+
+func decodeMissedEvent(data []byte, fileName string) (MissedEvent, error) {
+	var event MissedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return event, err
+	}
+	if event.Action != "" {
+		return event, nil
+	}
+	// the previous format stored the event payload itself, ordered by the file name
+	var legacy struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return event, err
+	}
+	event.Seq, _ = strconv.ParseInt(strings.TrimSuffix(fileName, ".json"), 10, 64)
+	switch {
+	case legacy.Path == "":
+		event.Action = MissedFullSync
+		event.Message = legacy.Message
+	case legacy.Content == "":
+		event.Action = MissedDelete
+		event.Path = legacy.Path
+	default:
+		event.Action = MissedUpdate
+		event.Path = legacy.Path
+	}
+	return event, nil
+}
+
+// writes an event to its file, replacing the previous event of the same path
+func writeMissedEvent(clientDir string, event MissedEvent) error {
+	name := fullSyncFile
+	if event.Action != MissedFullSync {
+		sum := sha256.Sum256([]byte(event.Path))
+		name = hex.EncodeToString(sum[:16]) + ".json"
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(clientDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
 	}
+	return os.Rename(tmp.Name(), filepath.Join(clientDir, name))
+}
 
-	// Clear the directory after retrieving events
-	if err := os.RemoveAll(clientDir); err != nil {
-		log.Printf("ERROR: Could not clear missed events directory for client %s: %v", clientID, err)
+// MissedEventCounts returns the number of queued events (paths, or a full sync) per client that has any.
+func MissedEventCounts(dataDir string) map[string]int {
+	counts := make(map[string]int)
+	missedMutex.Lock()
+	defer missedMutex.Unlock()
+	writeQueuedLocked()
+	clientDirs, err := os.ReadDir(filepath.Join(dataDir, MissedEventsDir))
+	if err != nil {
+		return counts
+	}
+	for _, clientDir := range clientDirs {
+		if !clientDir.IsDir() || !ValidDeviceID(clientDir.Name()) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dataDir, MissedEventsDir, clientDir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".json") {
+				counts[clientDir.Name()]++
+			}
+		}
 	}
+	return counts
+}
 
-	return events
+// CheckMissedEventsStore verifies that events can be queued, by writing and removing a probe file.
+func CheckMissedEventsStore(dataDir string) error {
+	dir := filepath.Join(dataDir, MissedEventsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
 }
 
 // IsClientActive checks if a client has an active SSE connection.
@@ -103,8 +412,3 @@ func (m *Manager) GetAllTrackedClients() []string {
 	}
 	return ids
 }
-
-// In this file, we're adding the functions to handle missed events.
-// The next step is to modify the Broadcast function in manager.go to use these.
-// We also add IsClientActive and GetAllTrackedClients to the Manager.
-var _ = &sync.Mutex{} // Dummy use of sync to avoid import error if FileSystemMutex is removed
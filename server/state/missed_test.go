@@ -0,0 +1,125 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tanq16/yamanaka/server/events"
+)
+
+func update(path string) events.FileEventData {
+	return events.FileEventData{Path: path, Content: "Y29udGVudA=="}
+}
+
+func remove(path string) events.FileEventData {
+	return events.FileEventData{Path: path}
+}
+
+func fullSync() events.FullSyncEventData {
+	return events.FullSyncEventData{Message: "full sync"}
+}
+
+// action and path of each pending event, oldest first
+func pendingSummary(dataDir, clientID string) []string {
+	var summary []string
+	for _, event := range PendingMissedEvents(dataDir, clientID) {
+		summary = append(summary, event.Action+" "+event.Path)
+	}
+	return summary
+}
+
+func TestMissedEventCompaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []any
+		want   []string
+	}{
+		{"latest update of a path wins", []any{update("a.md"), update("a.md")}, []string{"update a.md"}},
+		{"delete replaces update", []any{update("a.md"), remove("a.md")}, []string{"delete a.md"}},
+		{"update replaces delete", []any{remove("a.md"), update("a.md")}, []string{"update a.md"}},
+		{"rename keeps both paths in order", []any{remove("old.md"), update("new.md")}, []string{"delete old.md", "update new.md"}},
+		{"full sync drops everything before it", []any{update("a.md"), remove("b.md"), fullSync()}, []string{"full_sync "}},
+		{"nothing is queued behind a full sync", []any{fullSync(), update("a.md")}, []string{"full_sync "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			for _, event := range tt.events {
+				StoreMissedEvent(dataDir, "laptop", event)
+			}
+			if got := pendingSummary(dataDir, "laptop"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pending = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAckMissedEvents(t *testing.T) {
+	dataDir := t.TempDir()
+	first := StoreMissedEvent(dataDir, "laptop", update("a.md"))
+	second := StoreMissedEvent(dataDir, "laptop", update("b.md"))
+	third := StoreMissedEvent(dataDir, "laptop", update("a.md")) // replaces first
+	fourth := StoreMissedEvent(dataDir, "laptop", remove("c.md"))
+
+	steps := []struct {
+		ack         int64
+		wantRemoved int
+		want        []string
+	}{
+		{ack: first, wantRemoved: 0, want: []string{"update b.md", "update a.md", "delete c.md"}}, // replaced, nothing left to trim
+		{ack: second, wantRemoved: 1, want: []string{"update a.md", "delete c.md"}},
+		{ack: second, wantRemoved: 0, want: []string{"update a.md", "delete c.md"}},
+		{ack: fourth, wantRemoved: 2, want: nil},
+	}
+	for i, step := range steps {
+		if removed := AckMissedEvents(dataDir, "laptop", step.ack); removed != step.wantRemoved {
+			t.Errorf("step %d: removed %d events, want %d", i, removed, step.wantRemoved)
+		}
+		if got := pendingSummary(dataDir, "laptop"); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("step %d: pending = %q, want %q", i, got, step.want)
+		}
+	}
+	if third <= first {
+		t.Errorf("sequences do not grow: %d after %d", third, first)
+	}
+}
+
+func TestQueueMissedEventIsVisibleRightAway(t *testing.T) {
+	dataDir := t.TempDir()
+	seq := QueueMissedEvent(dataDir, []string{"laptop", "phone"}, update("a.md"))
+	for _, clientID := range []string{"laptop", "phone"} {
+		pending := PendingMissedEvents(dataDir, clientID)
+		if len(pending) != 1 || pending[0].Seq != seq || pending[0].Path != "a.md" {
+			t.Errorf("%s: pending = %+v, want a.md at %d", clientID, pending, seq)
+		}
+	}
+	// acknowledged while possibly still in memory, it must not come back
+	QueueMissedEvent(dataDir, []string{"laptop"}, update("b.md"))
+	AckMissedEvents(dataDir, "laptop", NextSeq())
+	FlushMissedEvents()
+	if got := pendingSummary(dataDir, "laptop"); got != nil {
+		t.Errorf("pending after ack = %q, want none", got)
+	}
+}
+
+func TestStoreMissedEventRejectsUnsafeIDs(t *testing.T) {
+	root := t.TempDir()
+	dataDir := filepath.Join(root, "data")
+	for _, id := range []string{"", ".", "..", "../escape", "a/b"} {
+		StoreMissedEvent(dataDir, id, update("a.md"))
+		QueueMissedEvent(dataDir, []string{id}, update("a.md"))
+	}
+	FlushMissedEvents()
+	var written []string
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			written = append(written, path)
+		}
+		return nil
+	})
+	if len(written) != 0 {
+		t.Errorf("events written for unsafe IDs: %v", written)
+	}
+}
@@ -2,13 +2,23 @@ package state
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"sync"
+	"time"
 )
 
+// TrackedClientsFile is the file (inside the data dir) listing every client that has connected.
+const TrackedClientsFile = "clients.json"
+
+// written first and renamed over TrackedClientsFile
+const trackedClientsTmp = TrackedClientsFile + ".tmp"
+
+// InternalPaths returns the data-dir relative paths that hold server state rather than vault content.
+func InternalPaths() []string {
+	return []string{TrackedClientsFile, trackedClientsTmp, MissedEventsDir}
+}
+
 // Ensure data directory exists
 func ensureDataDir(dataDir string) {
 	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
@@ -18,43 +28,94 @@ func ensureDataDir(dataDir string) {
 	}
 }
 
-// SaveTrackedClients saves the list of tracked client IDs to a file.
-func SaveTrackedClients(dataDir string, clientIDs map[string]bool, mutex *sync.RWMutex) {
-	mutex.RLock()
-	defer mutex.RUnlock()
+// DeviceRecord is what clients.json keeps about a device.
+type DeviceRecord struct {
+	Name          string    `json:"name,omitempty"`
+	Platform      string    `json:"platform,omitempty"`
+	PluginVersion string    `json:"plugin_version,omitempty"`
+	FirstSeen     time.Time `json:"first_seen,omitzero"` // zero for devices migrated from the old format
+	LastSeen      time.Time `json:"last_seen,omitzero"`
+	LastIP        string    `json:"last_ip,omitempty"`
+	DormantSince  time.Time `json:"dormant_since,omitzero"` // set while the device is dormant and collects no events
+	LastAck       int64     `json:"last_ack,omitempty"`     // highest event sequence the device acknowledged
+}
+
+// reports whether the device was marked dormant for inactivity
+func (d DeviceRecord) IsDormant() bool {
+	return !d.DormantSince.IsZero()
+}
 
+// SaveTrackedClients saves the tracked devices to a file, replacing it atomically.
+func SaveTrackedClients(dataDir string, clients map[string]DeviceRecord) {
 	ensureDataDir(dataDir)
-	path := filepath.Join(dataDir, "clients.json")
-	data, err := json.MarshalIndent(clientIDs, "", "  ")
+	path := filepath.Join(dataDir, TrackedClientsFile)
+	data, err := json.MarshalIndent(clients, "", "  ")
 	if err != nil {
 		log.Printf("Error marshalling tracked clients: %v", err)
 		return
 	}
-	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+	tmp := filepath.Join(dataDir, trackedClientsTmp)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error saving tracked clients: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
 		log.Printf("Error saving tracked clients: %v", err)
 	}
 }
 
-// LoadTrackedClients loads the list of tracked client IDs from a file.
-func LoadTrackedClients(dataDir string, mutex *sync.RWMutex) map[string]bool {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	path := filepath.Join(dataDir, "clients.json")
-	data, err := ioutil.ReadFile(path)
+// LoadTrackedClients loads the tracked devices from a file.
+// The old format, {"<device id>": true}, is read as devices without metadata and rewritten in the new one.
+func LoadTrackedClients(dataDir string) map[string]*DeviceRecord {
+	clients := make(map[string]*DeviceRecord)
+	path := filepath.Join(dataDir, TrackedClientsFile)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Println("clients.json not found, starting with an empty set of tracked clients.")
-			return make(map[string]bool)
+		} else {
+			log.Printf("Error reading tracked clients: %v", err)
 		}
-		log.Printf("Error reading tracked clients: %v", err)
-		return make(map[string]bool)
+		return clients
 	}
 
-	var clientIDs map[string]bool
-	if err := json.Unmarshal(data, &clientIDs); err != nil {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
 		log.Printf("Error unmarshalling tracked clients: %v", err)
-		return make(map[string]bool)
+		return clients
+	}
+	migrated := 0
+	for id, value := range raw {
+		if !ValidDeviceID(id) {
+			log.Printf("Skipping tracked client with invalid device ID %q.", id)
+			continue
+		}
+		var legacy bool
+		if json.Unmarshal(value, &legacy) == nil {
+			if legacy {
+				clients[id] = &DeviceRecord{}
+				migrated++
+			}
+			continue
+		}
+		record := &DeviceRecord{}
+		if err := json.Unmarshal(value, record); err != nil {
+			log.Printf("Error reading tracked client %s, skipping it: %v", id, err)
+			continue
+		}
+		clients[id] = record
+	}
+	if migrated > 0 {
+		log.Printf("Migrated %d tracked clients in clients.json to device records.", migrated)
+		SaveTrackedClients(dataDir, copyRecords(clients))
+	}
+	return clients
+}
+
+func copyRecords(clients map[string]*DeviceRecord) map[string]DeviceRecord {
+	records := make(map[string]DeviceRecord, len(clients))
+	for id, record := range clients {
+		records[id] = *record
 	}
-	return clientIDs
+	return records
 }
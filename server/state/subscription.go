@@ -0,0 +1,67 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/tanq16/yamanaka/server/events"
+)
+
+// DefaultQueueSize is how many events a connected client may fall behind before it is disconnected.
+const DefaultQueueSize = 256
+
+// reasons sent with a disconnected event
+const (
+	DisconnectReplaced     = "replaced"      // the device opened a newer stream
+	DisconnectAdmin        = "admin"         // an administrator ended the stream
+	DisconnectSlowConsumer = "slow_consumer" // the client did not keep up with its queue
+)
+
+// Subscription is the live event stream of one client session.
+// Events is a bounded queue filled by Broadcast without blocking; Done is closed when the server ends the session,
+// after which Final holds the event to send the client before closing the connection.
+type Subscription struct {
+	events chan any
+	done   chan struct{}
+	once   sync.Once
+	final  any
+}
+
+func newSubscription(size int) *Subscription {
+	return &Subscription{events: make(chan any, size), done: make(chan struct{})}
+}
+
+func (s *Subscription) Events() <-chan any {
+	return s.events
+}
+
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// the last event of a session ended by the server, nil when the client went away on its own
+// only valid once Done is closed
+func (s *Subscription) Final() any {
+	return s.final
+}
+
+// queues an event without blocking, returns false when the queue is full
+func (s *Subscription) offer(event any) bool {
+	select {
+	case s.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// ends the session once, final is what the client is told
+func (s *Subscription) end(final any) {
+	s.once.Do(func() {
+		s.final = final
+		close(s.done)
+	})
+}
+
+func disconnected(reason, message string) events.DisconnectedEventData {
+	return events.DisconnectedEventData{Reason: reason, Message: message}
+}
@@ -0,0 +1,220 @@
+package vault
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	commitRetryBaseBackoff = 5 * time.Second
+	commitRetryMaxBackoff  = 5 * time.Minute
+)
+
+// CommitRequest records one change set (usually a client push) waiting to be committed.
+type CommitRequest struct {
+	DeviceID string
+	Author   *CommitAuthor
+	Trailers []Trailer
+	Paths    []string
+}
+
+// CommitResult is reported once a batch of requests has been committed.
+type CommitResult struct {
+	Hash      string
+	DeviceIDs []string
+	Paths     []string
+	Err       error
+}
+
+// Committer groups change sets that arrive within a quiet window into a single background commit,
+// so handlers never run git themselves.
+type Committer struct {
+	vaultPath   string
+	quietWindow time.Duration
+	maxDelay    time.Duration
+	onCommit    func(CommitResult)
+
+	mutex       sync.Mutex
+	pending     []CommitRequest
+	firstQueued time.Time
+	lastQueued  time.Time
+	retryAt     time.Time     // after a failed commit, the batch waits until then
+	backoff     time.Duration // doubles with every failed commit in a row
+	wake        chan struct{}
+}
+
+// creates a committer; a batch is committed once no request arrived for quietWindow,
+// or at the latest maxDelay after its first request
+func NewCommitter(vaultPath string, quietWindow, maxDelay time.Duration, onCommit func(CommitResult)) *Committer {
+	if maxDelay < quietWindow {
+		maxDelay = quietWindow
+	}
+	return &Committer{
+		vaultPath:   vaultPath,
+		quietWindow: quietWindow,
+		maxDelay:    maxDelay,
+		onCommit:    onCommit,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// starts the background worker
+func (c *Committer) Start() {
+	slog.Info("commit-goroutine: started", "quiet window", c.quietWindow, "max delay", c.maxDelay)
+	go c.run()
+}
+
+// queues a change set for the next commit, never blocks on git
+func (c *Committer) Enqueue(req CommitRequest) {
+	c.mutex.Lock()
+	now := time.Now()
+	if len(c.pending) == 0 {
+		c.firstQueued = now
+	}
+	c.lastQueued = now
+	c.pending = append(c.pending, req)
+	c.mutex.Unlock()
+	c.signal()
+}
+
+// commits everything queued right away, used on shutdown and before the whole vault is committed
+// under the server identity, which would otherwise take over the queued pushes
+// a nil committer has nothing queued
+func (c *Committer) Flush() {
+	if c == nil {
+		return
+	}
+	c.commitPending()
+}
+
+func (c *Committer) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Committer) run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case <-c.wake:
+			c.mutex.Lock()
+			deadline := c.lastQueued.Add(c.quietWindow)
+			if latest := c.firstQueued.Add(c.maxDelay); latest.Before(deadline) {
+				deadline = latest
+			}
+			if deadline.Before(c.retryAt) {
+				deadline = c.retryAt
+			}
+			c.mutex.Unlock()
+			timer.Reset(time.Until(deadline))
+		case <-timer.C:
+			c.commitPending()
+		}
+	}
+}
+
+// commits everything queued so far as one commit
+// a batch that fails stays queued, ahead of later requests, and is retried with exponential backoff
+func (c *Committer) commitPending() {
+	c.mutex.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.mutex.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	message, author := batchMessage(batch)
+	result := CommitResult{DeviceIDs: batchDevices(batch), Paths: batchPaths(batch)}
+	// only the pushed paths, an external edit elsewhere gets its own commit from the watcher
+	result.Hash, result.Err = CommitPathsAs(c.vaultPath, result.Paths, message, author)
+	c.mutex.Lock()
+	if result.Err != nil {
+		if len(c.pending) == 0 {
+			c.firstQueued = time.Now()
+		}
+		c.pending = append(batch, c.pending...)
+		c.backoff = min(max(c.backoff*2, commitRetryBaseBackoff), commitRetryMaxBackoff)
+		c.retryAt = time.Now().Add(c.backoff)
+		slog.Error("commit-goroutine: failed to commit changes, retrying", "pushes", len(batch), "retry in", c.backoff, "error", result.Err)
+	} else {
+		c.backoff = 0
+		c.retryAt = time.Time{}
+		slog.Info("commit-goroutine: changes committed", "hash", result.Hash, "pushes", len(batch), "devices", result.DeviceIDs)
+	}
+	c.mutex.Unlock()
+	if result.Err != nil {
+		c.signal()
+	}
+	if c.onCommit != nil {
+		c.onCommit(result)
+	}
+}
+
+// builds the commit message for a batch; the first device is the author, the others co-authors
+func batchMessage(batch []CommitRequest) (string, *CommitAuthor) {
+	var author *CommitAuthor
+	var names []string
+	var trailers []Trailer
+	var coAuthors []Trailer
+	seenAuthors := make(map[string]bool)
+	seenTrailers := make(map[Trailer]bool)
+	for _, req := range batch {
+		if req.Author != nil && !seenAuthors[req.Author.Email] {
+			seenAuthors[req.Author.Email] = true
+			names = append(names, req.Author.Name)
+			if author == nil {
+				author = req.Author
+			} else {
+				coAuthors = append(coAuthors, Trailer{Key: "Co-authored-by", Value: fmt.Sprintf("%s <%s>", req.Author.Name, req.Author.Email)})
+			}
+		}
+		for _, t := range req.Trailers {
+			if !seenTrailers[t] {
+				seenTrailers[t] = true
+				trailers = append(trailers, t)
+			}
+		}
+	}
+
+	subject := "Client push"
+	if len(batch) > 1 {
+		subject = fmt.Sprintf("%d client pushes", len(batch))
+	}
+	if len(names) > 0 {
+		subject += " from " + strings.Join(names, ", ")
+	}
+	return WithTrailers(subject, append(trailers, coAuthors...)...), author
+}
+
+func batchDevices(batch []CommitRequest) []string {
+	var devices []string
+	seen := make(map[string]bool)
+	for _, req := range batch {
+		if req.DeviceID != "" && !seen[req.DeviceID] {
+			seen[req.DeviceID] = true
+			devices = append(devices, req.DeviceID)
+		}
+	}
+	return devices
+}
+
+func batchPaths(batch []CommitRequest) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, req := range batch {
+		for _, p := range req.Paths {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
@@ -0,0 +1,116 @@
+package vault
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func laptopPush(paths ...string) CommitRequest {
+	return CommitRequest{
+		DeviceID: "laptop",
+		Author:   DeviceAuthor("laptop", "Laptop"),
+		Trailers: []Trailer{{Key: "Device-Id", Value: "laptop"}},
+		Paths:    paths,
+	}
+}
+
+func phonePush(paths ...string) CommitRequest {
+	return CommitRequest{
+		DeviceID: "phone",
+		Author:   DeviceAuthor("phone", "Phone"),
+		Trailers: []Trailer{{Key: "Device-Id", Value: "phone"}},
+		Paths:    paths,
+	}
+}
+
+func TestCommitterBatchesWithinQuietWindow(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	results := make(chan CommitResult, 4)
+	committer := NewCommitter(vaultPath, 200*time.Millisecond, 5*time.Second, func(result CommitResult) {
+		results <- result
+	})
+	committer.Start()
+
+	writeTestFile(t, vaultPath, "a.md", "a")
+	committer.Enqueue(laptopPush("a.md"))
+	time.Sleep(50 * time.Millisecond)
+	writeTestFile(t, vaultPath, "b.md", "b")
+	committer.Enqueue(phonePush("b.md"))
+	writeTestFile(t, vaultPath, "a.md", "a again")
+	committer.Enqueue(laptopPush("a.md"))
+
+	var result CommitResult
+	select {
+	case result = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no commit within 5s")
+	}
+	if result.Err != nil {
+		t.Fatalf("commit failed: %v", result.Err)
+	}
+	if !slices.Equal(result.DeviceIDs, []string{"laptop", "phone"}) || !slices.Equal(result.Paths, []string{"a.md", "b.md"}) {
+		t.Errorf("result = %+v, want both devices and both paths", result)
+	}
+	select {
+	case extra := <-results:
+		t.Errorf("a second commit was made: %+v", extra)
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	commits, err := repo.FirstParentLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0].Hash != result.Hash {
+		t.Fatalf("history = %+v, want the one batch commit", commits)
+	}
+	if commits[0].AuthorName != "Laptop" {
+		t.Errorf("author = %q, want the first device", commits[0].AuthorName)
+	}
+	wantMessage := "3 client pushes from Laptop, Phone\n\nDevice-Id: laptop\nDevice-Id: phone\nCo-authored-by: Phone <phone@obsidian.sync>"
+	if got := strings.TrimSpace(commits[0].Message); got != wantMessage {
+		t.Errorf("message = %q, want %q", got, wantMessage)
+	}
+}
+
+func TestCommitterKeepsFailedBatch(t *testing.T) {
+	vaultPath := t.TempDir() // no repository yet, so the first commit fails
+	var results []CommitResult
+	committer := NewCommitter(vaultPath, time.Hour, time.Hour, func(result CommitResult) {
+		results = append(results, result)
+	})
+	writeTestFile(t, vaultPath, "a.md", "a")
+	committer.Enqueue(laptopPush("a.md"))
+	committer.Flush()
+	if len(results) != 1 || results[0].Err == nil {
+		t.Fatalf("results = %+v, want one failed commit", results)
+	}
+
+	if err := InitRepo(vaultPath); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, vaultPath, "b.md", "b")
+	committer.Enqueue(phonePush("b.md"))
+	committer.Flush()
+	if len(results) != 2 || results[1].Err != nil {
+		t.Fatalf("results = %+v, want the retry to succeed", results)
+	}
+	if !slices.Equal(results[1].DeviceIDs, []string{"laptop", "phone"}) || !slices.Equal(results[1].Paths, []string{"a.md", "b.md"}) {
+		t.Errorf("retried commit = %+v, want the failed push ahead of the new one", results[1])
+	}
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.FirstParentLog()
+	if err != nil || len(commits) != 1 || commits[0].AuthorName != "Laptop" {
+		t.Errorf("history = %+v (%v), want one commit by Laptop", commits, err)
+	}
+
+	committer.Flush() // nothing left
+	if len(results) != 2 {
+		t.Errorf("flushing an empty queue reported %+v", results[2:])
+	}
+}
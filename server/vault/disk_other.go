@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package vault
+
+import "errors"
+
+// free space is not reported on this platform
+func FreeDiskSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
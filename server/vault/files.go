@@ -3,9 +3,13 @@ package vault
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,6 +22,34 @@ type File struct {
 	Content string `json:"content"` // base64 encoded
 }
 
+// ErrInvalidPath is returned for paths that are empty, escape the vault or point into .git or a server directory.
+var ErrInvalidPath = errors.New("invalid path")
+
+// normalizes a vault-relative path and rejects paths that escape the vault or touch .git or server directories
+func CleanRelPath(relPath string) (string, error) {
+	if relPath == "" {
+		return "", fmt.Errorf("%w: path is required", ErrInvalidPath)
+	}
+	cleaned := filepath.ToSlash(filepath.Clean(filepath.FromSlash(relPath)))
+	if filepath.IsAbs(relPath) || strings.HasPrefix(cleaned, "/") || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: %q is outside the vault", ErrInvalidPath, relPath)
+	}
+	if cleaned == "." || isReservedPath(cleaned) {
+		return "", fmt.Errorf("%w: %q is not allowed", ErrInvalidPath, relPath)
+	}
+	return cleaned, nil
+}
+
+// reports whether a vault-relative path belongs to git or to a server directory (trash, staging)
+func isReservedPath(relPath string) bool {
+	for _, dir := range []string{".git", TrashDir, StagingDir} {
+		if relPath == dir || strings.HasPrefix(relPath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // walks vault and returns slice of all files (skip .git)
 func GetAllFiles(vaultPath string) ([]File, error) {
 	state.FileSystemMutex.RLock()
@@ -27,13 +59,17 @@ func GetAllFiles(vaultPath string) ([]File, error) {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() || strings.Contains(path, ".git") {
-			return nil
-		}
 		relPath, err := filepath.Rel(vaultPath, path)
 		if err != nil {
 			return err
 		}
+		// only the server directories at the vault root, a note folder may have the same name
+		if info.IsDir() && (filepath.ToSlash(relPath) == TrashDir || filepath.ToSlash(relPath) == StagingDir) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || strings.Contains(path, ".git") {
+			return nil
+		}
 		content, err := os.ReadFile(path)
 		if err != nil {
 			return err
@@ -47,84 +83,131 @@ func GetAllFiles(vaultPath string) ([]File, error) {
 	return files, err
 }
 
-// removes all files and dirs from vault except .git
-func CleanDir(vaultPath string) error {
-	state.FileSystemMutex.Lock()
-	defer state.FileSystemMutex.Unlock()
-	entries, err := os.ReadDir(vaultPath)
-	if err != nil {
-		return err
-	}
-	for _, entry := range entries {
-		if entry.Name() == ".git" {
-			continue
-		}
-		if err := os.RemoveAll(filepath.Join(vaultPath, entry.Name())); err != nil {
+// counts the vault's content files and their total size, skipping git, server directories and server state
+func VaultStats(vaultPath string) (files int, bytes int64, err error) {
+	err = filepath.WalkDir(vaultPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
-	}
-	return nil
+		relPath, _ := filepath.Rel(vaultPath, path)
+		relPath = filepath.ToSlash(relPath)
+		if relPath != "." && (isReservedPath(relPath) || isInternalPath(relPath)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes, err
 }
 
-// decompresses gzipped tar archive into destination
-func ExtractTarGz(gzipStream io.Reader, dst string) error {
-	state.FileSystemMutex.Lock()
-	defer state.FileSystemMutex.Unlock()
+// decompresses a gzipped tar archive into an empty staging directory and returns the sha256 of every file
+// entries escaping the directory are rejected, server state paths are skipped; a truncated or corrupt
+// stream fails on the gzip checksum or the tar structure
+func ExtractTarGz(gzipStream io.Reader, dst string) (map[string]string, error) {
 	uncompressedStream, err := gzip.NewReader(gzipStream)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer uncompressedStream.Close()
 	tarReader := tar.NewReader(uncompressedStream)
+	hashes := make(map[string]string)
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break // End of archive
 		}
 		if err != nil {
-			return err
+			return nil, err
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+		relPath, err := CleanRelPath(name)
+		if err != nil {
+			return nil, err
+		}
+		if isInternalPath(relPath) {
+			continue
 		}
-		target := filepath.Join(dst, header.Name)
+		target := filepath.Join(dst, filepath.FromSlash(relPath))
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(target, 0755); err != nil {
-				return err
+				return nil, err
 			}
 		case tar.TypeReg:
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
+				return nil, err
 			}
 			outFile, err := os.Create(target)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
+			hasher := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(outFile, hasher), tarReader); err != nil {
 				outFile.Close()
-				return err
+				return nil, err
+			}
+			if err := outFile.Close(); err != nil {
+				return nil, err
 			}
-			outFile.Close()
+			hashes[relPath] = hex.EncodeToString(hasher.Sum(nil))
 		default:
-			return fmt.Errorf("unsupported file type in tar: %c for %s", header.Typeflag, header.Name)
+			return nil, fmt.Errorf("unsupported file type in tar: %c for %s", header.Typeflag, header.Name)
 		}
 	}
-	return nil
+	// the gzip checksum is only verified once the stream is read to the end
+	if _, err := io.Copy(io.Discard, uncompressedStream); err != nil {
+		return nil, err
+	}
+	return hashes, nil
 }
 
 // writes content to a specific file path
 func WriteFile(vaultPath, relPath string, content []byte) error {
+	relPath, err := CleanRelPath(relPath)
+	if err != nil {
+		return err
+	}
 	state.FileSystemMutex.Lock()
 	defer state.FileSystemMutex.Unlock()
-	fullPath := filepath.Join(vaultPath, relPath)
+	fullPath := filepath.Join(vaultPath, filepath.FromSlash(relPath))
 	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
 		return err
 	}
+	noteServerWrite(relPath, content)
 	return os.WriteFile(fullPath, content, 0644)
 }
 
-// removes a file from vault
-func DeleteFile(vaultPath, relPath string) error {
+// reads the current content of a vault file
+func ReadFile(vaultPath, relPath string) ([]byte, error) {
+	relPath, err := CleanRelPath(relPath)
+	if err != nil {
+		return nil, err
+	}
+	state.FileSystemMutex.RLock()
+	defer state.FileSystemMutex.RUnlock()
+	return os.ReadFile(filepath.Join(vaultPath, filepath.FromSlash(relPath)))
+}
+
+// removes a file from vault by moving it into the trash
+func DeleteFile(vaultPath, relPath, deviceID string) error {
 	state.FileSystemMutex.Lock()
 	defer state.FileSystemMutex.Unlock()
-	fullPath := filepath.Join(vaultPath, relPath)
-	return os.Remove(fullPath)
+	relPath, err := CleanRelPath(relPath)
+	if err != nil {
+		return err
+	}
+	return moveToTrash(vaultPath, relPath, deviceID)
 }
@@ -0,0 +1,72 @@
+package vault
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileRejectsReservedPaths(t *testing.T) {
+	root := t.TempDir()
+	vaultPath := filepath.Join(root, "vault")
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"notes/a.md", false},
+		{"./notes/../b.md", false},
+		{"notes/" + TrashDir + "/c.md", false}, // only the directories at the vault root are reserved
+		{"", true},
+		{".", true},
+		{"../outside.md", true},
+		{"notes/../../outside.md", true},
+		{"/etc/passwd", true},
+		{".git/config", true},
+		{TrashDir + "/1/meta.json", true},
+		{StagingDir + "/sync-1/new/a.md", true},
+	}
+	for _, tt := range tests {
+		err := WriteFile(vaultPath, tt.path, []byte("x"))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("WriteFile(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+		}
+		if tt.wantErr && !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("WriteFile(%q) error = %v, want ErrInvalidPath", tt.path, err)
+		}
+	}
+	for _, relPath := range []string{"outside.md", "vault/.git/config", "vault/" + TrashDir, "vault/" + StagingDir} {
+		if _, err := os.Stat(filepath.Join(root, relPath)); !os.IsNotExist(err) {
+			t.Errorf("%s was written: %v", relPath, err)
+		}
+	}
+}
+
+func TestGetAllFilesSkipsServerDirectories(t *testing.T) {
+	vaultPath := t.TempDir()
+	writeTestFile(t, vaultPath, "a.md", "a")
+	writeTestFile(t, vaultPath, "notes/"+TrashDir+"/kept.md", "a user folder with a reserved name")
+	writeTestFile(t, vaultPath, TrashDir+"/1/content", "deleted")
+	writeTestFile(t, vaultPath, StagingDir+"/sync-1/new/a.md", "upload")
+	writeTestFile(t, vaultPath, ".git/HEAD", "ref: refs/heads/master")
+
+	files, err := GetAllFiles(vaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, file := range files {
+		content, _ := base64.StdEncoding.DecodeString(file.Content)
+		got[file.Path] = string(content)
+	}
+	want := map[string]string{"a.md": "a", "notes/" + TrashDir + "/kept.md": "a user folder with a reserved name"}
+	if len(got) != len(want) {
+		t.Errorf("GetAllFiles() = %v, want %v", got, want)
+	}
+	for relPath, content := range want {
+		if got[relPath] != content {
+			t.Errorf("%s = %q, want %q", relPath, got[relPath], content)
+		}
+	}
+}
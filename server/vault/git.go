@@ -3,10 +3,12 @@ package vault
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/tanq16/yamanaka/server/metrics"
 	"github.com/tanq16/yamanaka/server/state"
 )
 
@@ -14,66 +16,186 @@ import (
 func InitRepo(vaultPath string) error {
 	gitPath := filepath.Join(vaultPath, ".git")
 	if _, err := os.Stat(gitPath); os.IsNotExist(err) {
-		cmd := exec.Command("git", "init")
-		cmd.Dir = vaultPath
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to run 'git init': %w", err)
+		if _, err := git.PlainInit(vaultPath, false); err != nil {
+			return fmt.Errorf("failed to initialize git repository: %w", err)
 		}
-		configUserNameCmd := exec.Command("git", "config", "user.name", "yamanaka")
-		configUserNameCmd.Dir = vaultPath
-		if err := configUserNameCmd.Run(); err != nil {
-			return fmt.Errorf("failed to set git config user.name: %w", err)
-		}
-		configUserEmailCmd := exec.Command("git", "config", "user.email", "yamanaka@obsidian.sync")
-		configUserEmailCmd.Dir = vaultPath
-		if err := configUserEmailCmd.Run(); err != nil {
-			return fmt.Errorf("failed to set git config user.email: %w", err)
+	}
+	if err := ensureExcluded(vaultPath, TrashDir+"/"); err != nil {
+		return err
+	}
+	return ensureExcluded(vaultPath, StagingDir+"/")
+}
+
+// adds a pattern to .git/info/exclude if it is not there yet
+func ensureExcluded(vaultPath, pattern string) error {
+	excludePath := filepath.Join(vaultPath, ".git", "info", "exclude")
+	existing, err := os.ReadFile(excludePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(existing), "\n") {
+		if strings.TrimSpace(line) == pattern {
+			return nil
 		}
 	}
-	return nil
+	if err := os.MkdirAll(filepath.Dir(excludePath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(excludePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if len(existing) > 0 && !strings.HasSuffix(string(existing), "\n") {
+		pattern = "\n" + pattern
+	}
+	_, err = f.WriteString(pattern + "\n")
+	return err
 }
 
-// returns the latest commit hash (HEAD)
+// returns the latest commit hash (HEAD), empty before the first commit
 func GetCurrentHash(vaultPath string) (string, error) {
-	cmd := exec.Command("git", "rev-parse", "HEAD")
-	cmd.Dir = vaultPath
-	out, err := cmd.Output()
+	repo, err := OpenRepo(vaultPath)
 	if err != nil {
-		if _, ok := err.(*exec.ExitError); ok {
-			return "", nil
+		return "", err
+	}
+	return repo.Head()
+}
+
+// CommitAuthor is who a commit is attributed to; the committer always stays yamanaka.
+type CommitAuthor struct {
+	Name  string
+	Email string
+}
+
+// Trailer is a "Key: Value" line appended to a commit message.
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+// builds the author for a device, using its friendly name when known and its id otherwise
+func DeviceAuthor(deviceID, deviceName string) *CommitAuthor {
+	if deviceID == "" {
+		return nil
+	}
+	name := sanitizeIdent(deviceName)
+	if name == "" {
+		name = sanitizeIdent(deviceID)
+	}
+	return &CommitAuthor{Name: name, Email: sanitizeIdent(deviceID) + "@obsidian.sync"}
+}
+
+// strips characters git does not allow in author names and emails
+func sanitizeIdent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '<', '>', '\n', '\r':
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// appends trailers (skipping empty values) to a commit message
+func WithTrailers(message string, trailers ...Trailer) string {
+	var lines []string
+	for _, t := range trailers {
+		value := strings.TrimSpace(strings.ReplaceAll(t.Value, "\n", " "))
+		if value != "" {
+			lines = append(lines, t.Key+": "+value)
 		}
-		return "", fmt.Errorf("failed to get current hash: %w", err)
 	}
-	return strings.TrimSpace(string(out)), nil
+	if len(lines) == 0 {
+		return message
+	}
+	return message + "\n\n" + strings.Join(lines, "\n")
 }
 
 // stages all changes and creates a new commit
 func CommitChanges(vaultPath, message string) (string, error) {
+	return CommitChangesAs(vaultPath, message, nil)
+}
+
+// stages all changes and creates a new commit attributed to author (nil keeps the default identity)
+func CommitChangesAs(vaultPath, message string, author *CommitAuthor) (string, error) {
 	state.FileSystemMutex.Lock()
 	defer state.FileSystemMutex.Unlock()
-	addCmd := exec.Command("git", "add", "-A")
-	addCmd.Dir = vaultPath
-	if output, err := addCmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("failed to run 'git add -A': %w\nOutput: %s", err, string(output))
-	}
-	statusCmd := exec.Command("git", "status", "--porcelain")
-	statusCmd.Dir = vaultPath
-	statusOutput, err := statusCmd.Output()
+	return commitLocked(vaultPath, nil, message, author)
+}
+
+// commits only the given paths, changes elsewhere in the worktree are left for their own commit
+func CommitPathsAs(vaultPath string, paths []string, message string, author *CommitAuthor) (string, error) {
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	return commitLocked(vaultPath, paths, message, author)
+}
+
+// same as CommitChangesAs (nil paths) or CommitPathsAs, caller must hold state.FileSystemMutex
+func commitLocked(vaultPath string, paths []string, message string, author *CommitAuthor) (string, error) {
+	defer metrics.CommitDuration.Since(time.Now())
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		recordCommit("", err)
+		metrics.Commits.Inc("failed")
+		return "", err
+	}
+	var hash string
+	if paths == nil {
+		hash, err = repo.CommitAll(message, author)
+	} else {
+		hash, err = repo.CommitPaths(paths, message, author)
+	}
+	recordCommit(hash, err)
 	if err != nil {
-		return "", fmt.Errorf("failed to run 'git status --porcelain': %w", err)
-	}
-	if len(strings.TrimSpace(string(statusOutput))) == 0 {
-		return GetCurrentHash(vaultPath) // Return the existing hash
-	}
-	commitCmd := exec.Command("git", "commit", "-m", message)
-	commitCmd.Dir = vaultPath
-	if output, err := commitCmd.CombinedOutput(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if strings.Contains(string(exitErr.Stderr), "nothing to commit") || strings.Contains(string(output), "nothing to commit") {
-				return GetCurrentHash(vaultPath) // Return the existing hash
-			}
+		metrics.Commits.Inc("failed")
+		return "", err
+	}
+	metrics.Commits.Inc("ok")
+	return hash, nil
+}
+
+// returns the last commit made at or before the given time
+func RevisionAt(vaultPath string, at time.Time) (string, error) {
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return "", err
+	}
+	commits, err := repo.Log(LogOptions{Until: at, Limit: 1})
+	if err != nil {
+		return "", err
+	}
+	if len(commits) == 0 {
+		return "", fmt.Errorf("no commit found at or before %s", at.Format(time.RFC3339))
+	}
+	return commits[0].Hash, nil
+}
+
+// reports whether a vault-relative path holds server state (clients.json, missed_events) rather than notes
+func isInternalPath(relPath string) bool {
+	for _, p := range state.InternalPaths() {
+		if relPath == p || strings.HasPrefix(relPath, p+"/") {
+			return true
 		}
-		return "", fmt.Errorf("failed to run 'git commit -m \"%s\"': %w\nOutput: %s", message, err, string(output))
 	}
-	return GetCurrentHash(vaultPath)
+	return false
+}
+
+// restores the whole vault to the tree of target and records it as a new commit (history is never rewritten)
+// uncommitted changes are committed first so the pre-rollback state stays reachable
+func Rollback(vaultPath, target, message string, author *CommitAuthor) (string, error) {
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := repo.CommitAll("Pre-rollback snapshot", nil); err != nil {
+		return "", err
+	}
+	if err := repo.CheckoutFiles(target, isInternalPath); err != nil {
+		return "", err
+	}
+	return repo.CommitAll(message, author)
 }
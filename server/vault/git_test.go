@@ -0,0 +1,58 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+func TestRollback(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	writeTestFile(t, vaultPath, "keep.md", "v1")
+	target := commitFile(t, vaultPath, repo, "gone.md", "only in v1")
+	writeTestFile(t, vaultPath, "keep.md", "v2")
+	if err := os.Remove(filepath.Join(vaultPath, "gone.md")); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, vaultPath, repo, "added.md", "after v1")
+	// not committed yet, and server state that a rollback must leave alone
+	writeTestFile(t, vaultPath, "keep.md", "v3, uncommitted")
+	writeTestFile(t, vaultPath, state.TrackedClientsFile, `{"laptop": {}}`)
+
+	newHash, err := Rollback(vaultPath, target, "Rollback to v1", nil)
+	if err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	for relPath, want := range map[string]string{"keep.md": "v1", "gone.md": "only in v1", state.TrackedClientsFile: `{"laptop": {}}`} {
+		content, err := os.ReadFile(filepath.Join(vaultPath, relPath))
+		if err != nil || string(content) != want {
+			t.Errorf("%s = %q (%v), want %q", relPath, content, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(vaultPath, "added.md")); !os.IsNotExist(err) {
+		t.Errorf("added.md still exists after the rollback: %v", err)
+	}
+
+	// the rollback is a new commit on top, and the uncommitted state before it was saved
+	commits, err := repo.FirstParentLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 4 || commits[0].Hash != newHash || commits[1].Message != "Pre-rollback snapshot" {
+		t.Fatalf("history after rollback = %+v, want the rollback on top of a pre-rollback snapshot", commits)
+	}
+	saved, _, err := repo.ReadFile(commits[1].Hash, "keep.md")
+	if err != nil || string(saved) != "v3, uncommitted" {
+		t.Errorf("pre-rollback snapshot has keep.md = %q (%v), want the uncommitted version", saved, err)
+	}
+	files, err := repo.ListFiles(newHash, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{state.TrackedClientsFile, "gone.md", "keep.md"}; !slices.Equal(files, want) {
+		t.Errorf("files at the rollback commit = %v, want %v", files, want)
+	}
+}
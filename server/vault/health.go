@@ -0,0 +1,84 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CommitStatus is the outcome of the latest commits made through CommitChanges and the committer.
+type CommitStatus struct {
+	LastAttempt time.Time `json:"last_attempt,omitzero"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastHash    string    `json:"last_hash,omitempty"`
+	LastError   string    `json:"last_error,omitempty"` // error of the last attempt, empty if it succeeded
+}
+
+var (
+	commitStatusMutex sync.Mutex
+	commitStatus      CommitStatus
+)
+
+func recordCommit(hash string, err error) {
+	commitStatusMutex.Lock()
+	defer commitStatusMutex.Unlock()
+	commitStatus.LastAttempt = time.Now().UTC()
+	if err != nil {
+		commitStatus.LastError = err.Error()
+		return
+	}
+	commitStatus.LastError = ""
+	commitStatus.LastSuccess = commitStatus.LastAttempt
+	commitStatus.LastHash = hash
+}
+
+// returns the outcome of the latest commits since the server started
+func LastCommitStatus() CommitStatus {
+	commitStatusMutex.Lock()
+	defer commitStatusMutex.Unlock()
+	return commitStatus
+}
+
+// makes sure the repository can be read: HEAD resolves and its commit object loads
+// returns the HEAD commit, zero for a repository without commits
+func CheckRepo(vaultPath string) (CommitInfo, error) {
+	if _, err := os.Stat(filepath.Join(vaultPath, ".git", "HEAD")); err != nil {
+		return CommitInfo{}, err
+	}
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return CommitInfo{}, err
+	}
+	head, err := repo.Head()
+	if err != nil || head == "" {
+		return CommitInfo{}, err
+	}
+	commits, err := repo.Log(LogOptions{From: head, Limit: 1})
+	if err != nil || len(commits) == 0 {
+		return CommitInfo{}, err
+	}
+	return commits[0], nil
+}
+
+// writes and removes a probe file inside the vault (in the staging directory, which is never synced or committed)
+func CheckWritable(vaultPath string) error {
+	dir := filepath.Join(vaultPath, StagingDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, "probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(probe.Name())
+	if _, err := probe.WriteString("ok"); err != nil {
+		probe.Close()
+		return err
+	}
+	if err := probe.Sync(); err != nil {
+		probe.Close()
+		return err
+	}
+	return probe.Close()
+}
@@ -0,0 +1,201 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// number of leading bytes inspected when deciding if content is binary (same heuristic as git)
+const binarySniffLen = 8000
+
+// BlobSummary describes one side of a binary diff.
+type BlobSummary struct {
+	Exists bool   `json:"exists"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// DiffLine is a single line inside a hunk.
+type DiffLine struct {
+	Type    string `json:"type"` // "context", "add" or "delete"
+	Content string `json:"content"`
+}
+
+// DiffHunk is one "@@ ... @@" section of a unified diff.
+type DiffHunk struct {
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Header   string     `json:"header"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// FileDiff is the difference of a single file between two revisions.
+type FileDiff struct {
+	Path   string       `json:"path"`
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Binary bool         `json:"binary"`
+	Diff   string       `json:"diff,omitempty"`
+	Hunks  []DiffHunk   `json:"hunks,omitempty"`
+	Old    *BlobSummary `json:"old,omitempty"`
+	New    *BlobSummary `json:"new,omitempty"`
+}
+
+// resolves a revision (hash, branch, tag, HEAD~n) to a full commit hash
+func ResolveRevision(vaultPath, rev string) (string, error) {
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return "", err
+	}
+	return repo.Resolve(rev)
+}
+
+// returns the content of a file at a revision, exists is false if the file is not in that revision
+func ReadFileAt(vaultPath, rev, relPath string) (content []byte, exists bool, err error) {
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return nil, false, err
+	}
+	return repo.ReadFile(rev, relPath)
+}
+
+// builds a diff for one file between two revisions, binary files only get a size/hash summary
+func DiffFile(vaultPath, from, to, relPath string) (*FileDiff, error) {
+	relPath, err := CleanRelPath(relPath)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return nil, err
+	}
+	fromHash, err := repo.Resolve(from)
+	if err != nil {
+		return nil, err
+	}
+	toHash, err := repo.Resolve(to)
+	if err != nil {
+		return nil, err
+	}
+	oldContent, oldExists, err := repo.ReadFile(fromHash, relPath)
+	if err != nil {
+		return nil, err
+	}
+	newContent, newExists, err := repo.ReadFile(toHash, relPath)
+	if err != nil {
+		return nil, err
+	}
+	if !oldExists && !newExists {
+		return nil, fmt.Errorf("%s does not exist in %s or %s", relPath, from, to)
+	}
+
+	result := &FileDiff{Path: relPath, From: fromHash, To: toHash}
+	if IsBinary(oldContent) || IsBinary(newContent) {
+		result.Binary = true
+		result.Old = summarizeBlob(oldContent, oldExists)
+		result.New = summarizeBlob(newContent, newExists)
+		return result, nil
+	}
+	result.Diff, err = repo.DiffFile(fromHash, toHash, relPath)
+	if err != nil {
+		return nil, err
+	}
+	result.Hunks = ParseHunks(result.Diff)
+	return result, nil
+}
+
+// reports whether content looks binary (contains a NUL byte near the start)
+func IsBinary(content []byte) bool {
+	if len(content) > binarySniffLen {
+		content = content[:binarySniffLen]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+func summarizeBlob(content []byte, exists bool) *BlobSummary {
+	if !exists {
+		return &BlobSummary{Exists: false}
+	}
+	sum := sha256.Sum256(content)
+	return &BlobSummary{Exists: true, Size: len(content), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// parses the hunks of a unified diff into a structured list
+func ParseHunks(diff string) []DiffHunk {
+	var hunks []DiffHunk
+	var current *DiffHunk
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "@@") {
+			hunk, ok := parseHunkHeader(line)
+			if !ok {
+				current = nil
+				continue
+			}
+			hunks = append(hunks, hunk)
+			current = &hunks[len(hunks)-1]
+			continue
+		}
+		if current == nil || line == "" {
+			continue
+		}
+		switch line[0] {
+		case ' ':
+			current.Lines = append(current.Lines, DiffLine{Type: "context", Content: line[1:]})
+		case '+':
+			current.Lines = append(current.Lines, DiffLine{Type: "add", Content: line[1:]})
+		case '-':
+			current.Lines = append(current.Lines, DiffLine{Type: "delete", Content: line[1:]})
+		}
+	}
+	return hunks
+}
+
+// parses "@@ -a,b +c,d @@ section"
+func parseHunkHeader(line string) (DiffHunk, bool) {
+	end := strings.Index(line[2:], "@@")
+	if end == -1 {
+		return DiffHunk{}, false
+	}
+	ranges := strings.Fields(line[2 : end+2])
+	if len(ranges) != 2 || !strings.HasPrefix(ranges[0], "-") || !strings.HasPrefix(ranges[1], "+") {
+		return DiffHunk{}, false
+	}
+	oldStart, oldLines, ok := parseHunkRange(ranges[0][1:])
+	if !ok {
+		return DiffHunk{}, false
+	}
+	newStart, newLines, ok := parseHunkRange(ranges[1][1:])
+	if !ok {
+		return DiffHunk{}, false
+	}
+	return DiffHunk{
+		OldStart: oldStart,
+		OldLines: oldLines,
+		NewStart: newStart,
+		NewLines: newLines,
+		Header:   strings.TrimSpace(line[end+4:]),
+	}, true
+}
+
+// parses "start,count" or "start" (count defaults to 1)
+func parseHunkRange(r string) (int, int, bool) {
+	startStr, countStr, found := strings.Cut(r, ",")
+	start, err := strconv.Atoi(startStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !found {
+		return start, 1, true
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, count, true
+}
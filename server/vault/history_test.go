@@ -0,0 +1,74 @@
+package vault
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHunks(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want []DiffHunk
+	}{
+		{
+			name: "empty",
+			diff: "",
+			want: nil,
+		},
+		{
+			name: "one hunk with section header",
+			diff: "--- a/a.md\n+++ b/a.md\n@@ -1,3 +1,3 @@ # Title\n one\n-two\n+deux\n three\n",
+			want: []DiffHunk{{
+				OldStart: 1, OldLines: 3, NewStart: 1, NewLines: 3, Header: "# Title",
+				Lines: []DiffLine{
+					{Type: "context", Content: "one"},
+					{Type: "delete", Content: "two"},
+					{Type: "add", Content: "deux"},
+					{Type: "context", Content: "three"},
+				},
+			}},
+		},
+		{
+			name: "counts default to one",
+			diff: "@@ -4 +4 @@\n-old\n+new\n",
+			want: []DiffHunk{{
+				OldStart: 4, OldLines: 1, NewStart: 4, NewLines: 1,
+				Lines: []DiffLine{{Type: "delete", Content: "old"}, {Type: "add", Content: "new"}},
+			}},
+		},
+		{
+			name: "new file",
+			diff: "@@ -0,0 +1,2 @@\n+a\n+b\n\\ No newline at end of file\n",
+			want: []DiffHunk{{
+				OldStart: 0, OldLines: 0, NewStart: 1, NewLines: 2,
+				Lines: []DiffLine{{Type: "add", Content: "a"}, {Type: "add", Content: "b"}},
+			}},
+		},
+		{
+			name: "two hunks",
+			diff: "@@ -1,1 +1,1 @@\n-a\n+b\n@@ -10,2 +10,1 @@\n x\n-y\n",
+			want: []DiffHunk{
+				{OldStart: 1, OldLines: 1, NewStart: 1, NewLines: 1,
+					Lines: []DiffLine{{Type: "delete", Content: "a"}, {Type: "add", Content: "b"}}},
+				{OldStart: 10, OldLines: 2, NewStart: 10, NewLines: 1,
+					Lines: []DiffLine{{Type: "context", Content: "x"}, {Type: "delete", Content: "y"}}},
+			},
+		},
+		{
+			name: "malformed header drops its lines",
+			diff: "@@ -x +1 @@\n+lost\n@@ -2,1 +2,1 @@\n+kept\n",
+			want: []DiffHunk{{
+				OldStart: 2, OldLines: 1, NewStart: 2, NewLines: 1,
+				Lines: []DiffLine{{Type: "add", Content: "kept"}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseHunks(tt.diff); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHunks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
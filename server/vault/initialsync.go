@@ -0,0 +1,172 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+// StagingDir holds uploads while they are unpacked and checked. It lives inside the vault
+// so swapping them in is a series of renames on the same file system.
+const StagingDir = ".yamanaka_staging"
+
+// ErrInvalidArchive is returned when an uploaded archive cannot be unpacked.
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// ReplaceResult describes a vault replaced by an initial sync.
+type ReplaceResult struct {
+	Snapshot string `json:"snapshot,omitempty"` // snapshot of the state before the reset, empty for a new vault
+	Hash     string `json:"hash"`
+	Files    int    `json:"files"`
+}
+
+// replaces the vault with the files of a gzipped tarball
+// the archive is unpacked and checked in a staging directory first, the current state is committed and
+// tagged as a snapshot, and the previous files are moved back if anything fails; server state is kept
+func ReplaceVault(vaultPath string, archive io.Reader, message string, author *CommitAuthor) (ReplaceResult, error) {
+	var result ReplaceResult
+	staging, err := newStaging(vaultPath)
+	if err != nil {
+		return result, err
+	}
+	keepStaging := false
+	defer func() {
+		if !keepStaging {
+			os.RemoveAll(staging)
+		}
+	}()
+	newDir := filepath.Join(staging, "new")
+	oldDir := filepath.Join(staging, "old")
+	if err := os.Mkdir(oldDir, 0755); err != nil {
+		return result, err
+	}
+	hashes, err := ExtractTarGz(archive, newDir)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	result.Files = len(hashes)
+
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return result, err
+	}
+	head, err := repo.CommitAll("Pre-initial-sync snapshot", nil)
+	if err != nil {
+		return result, err
+	}
+	if head != "" {
+		name := "pre-initial-sync-" + time.Now().UTC().Format("20060102-150405")
+		snapshot, err := tagSnapshot(repo, name, head, "", author)
+		if err != nil && !errors.Is(err, ErrSnapshotExists) {
+			return result, err
+		}
+		result.Snapshot = snapshot.Name
+	}
+
+	for relPath, hash := range hashes {
+		noteServerHash(relPath, hash)
+	}
+	restore, err := swapEntries(vaultPath, newDir, oldDir)
+	// whatever could not be moved back is still in oldDir, so the staging directory has to stay
+	undo := func() {
+		if !restore() {
+			keepStaging = true
+			slog.Error("initial sync: previous files could not all be restored, they were left in place", "path", oldDir)
+		}
+	}
+	if err != nil {
+		undo()
+		return result, fmt.Errorf("failed to swap in the new vault: %w", err)
+	}
+	if result.Hash, err = repo.CommitAll(message, author); err != nil {
+		undo()
+		return result, err
+	}
+	return result, nil
+}
+
+// creates a private directory below StagingDir with an empty "new" directory for the upload
+func newStaging(vaultPath string) (string, error) {
+	if err := os.MkdirAll(filepath.Join(vaultPath, StagingDir), 0755); err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(filepath.Join(vaultPath, StagingDir), "sync-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(filepath.Join(staging, "new"), 0755); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	return staging, nil
+}
+
+// moves the replaceable entries of the vault root to oldDir and those of newDir into the vault
+// restore undoes whatever was moved, it is safe to call after a partial swap, and reports whether every
+// previous entry is back in the vault
+func swapEntries(vaultPath, newDir, oldDir string) (restore func() bool, err error) {
+	var movedOut, movedIn []string
+	restore = func() bool {
+		for _, name := range movedIn {
+			noteServerRemoveTree(vaultPath, filepath.Join(vaultPath, name))
+			if err := os.RemoveAll(filepath.Join(vaultPath, name)); err != nil {
+				slog.Error("initial sync: could not remove new entry while restoring", "name", name, "error", err)
+			}
+		}
+		restored := true
+		for _, name := range movedOut {
+			if err := os.Rename(filepath.Join(oldDir, name), filepath.Join(vaultPath, name)); err != nil {
+				slog.Error("initial sync: could not restore previous entry", "name", name, "error", err)
+				restored = false
+			}
+		}
+		return restored
+	}
+
+	oldEntries, err := replaceableEntries(vaultPath)
+	if err != nil {
+		return restore, err
+	}
+	newEntries, err := replaceableEntries(newDir)
+	if err != nil {
+		return restore, err
+	}
+	for _, name := range oldEntries {
+		noteServerRemoveTree(vaultPath, filepath.Join(vaultPath, name))
+		if err := os.Rename(filepath.Join(vaultPath, name), filepath.Join(oldDir, name)); err != nil {
+			return restore, err
+		}
+		movedOut = append(movedOut, name)
+	}
+	for _, name := range newEntries {
+		if err := os.Rename(filepath.Join(newDir, name), filepath.Join(vaultPath, name)); err != nil {
+			return restore, err
+		}
+		movedIn = append(movedIn, name)
+	}
+	return restore, nil
+}
+
+// names in the root of dir that belong to the vault content (not git, server directories or server state)
+func replaceableEntries(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if isReservedPath(entry.Name()) || isInternalPath(entry.Name()) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+func TestReplaceVault(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	writeTestFile(t, vaultPath, "notes/old.md", "old")
+	writeTestFile(t, vaultPath, state.TrackedClientsFile, `{"laptop": {}}`)
+	previous := commitFile(t, vaultPath, repo, "a.md", "before the sync")
+
+	result, err := ReplaceVault(vaultPath, testArchive(t, map[string]string{"a.md": "uploaded", "new/b.md": "b"}), "Initial sync", nil)
+	if err != nil {
+		t.Fatalf("ReplaceVault: %v", err)
+	}
+	if result.Files != 2 || result.Snapshot == "" {
+		t.Errorf("result = %+v, want 2 files and a snapshot", result)
+	}
+	if hash, err := ResolveSnapshot(vaultPath, result.Snapshot); err != nil || hash != previous {
+		t.Errorf("snapshot %s at %s (%v), want the previous head %s", result.Snapshot, hash, err, previous)
+	}
+	for relPath, want := range map[string]string{"a.md": "uploaded", "new/b.md": "b", state.TrackedClientsFile: `{"laptop": {}}`} {
+		if data, err := os.ReadFile(filepath.Join(vaultPath, filepath.FromSlash(relPath))); err != nil || string(data) != want {
+			t.Errorf("%s = %q (%v), want %q", relPath, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(vaultPath, "notes")); !os.IsNotExist(err) {
+		t.Errorf("notes/ survived the replacement: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(vaultPath, StagingDir)); len(entries) != 0 {
+		t.Errorf("staging directory left behind: %v", entries)
+	}
+	files, err := repo.ListFiles(result.Hash, "")
+	if wantFiles := []string{"a.md", state.TrackedClientsFile, "new/b.md"}; err != nil || !slices.Equal(files, wantFiles) {
+		t.Errorf("files at %s = %v (%v), want %v", result.Hash, files, err, wantFiles)
+	}
+}
+
+func TestReplaceVaultRejectsInvalidArchive(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	head := commitFile(t, vaultPath, repo, "a.md", "kept")
+	archive := testArchive(t, map[string]string{"a.md": "uploaded", "b.md": "b"})
+	truncated := bytes.NewReader(archive.Bytes()[:archive.Len()/2])
+
+	if _, err := ReplaceVault(vaultPath, truncated, "Initial sync", nil); !errors.Is(err, ErrInvalidArchive) {
+		t.Fatalf("ReplaceVault() error = %v, want ErrInvalidArchive", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(vaultPath, "a.md")); err != nil || string(data) != "kept" {
+		t.Errorf("a.md = %q (%v), want the vault untouched", data, err)
+	}
+	if current, err := repo.Head(); err != nil || current != head {
+		t.Errorf("head = %s (%v), want no new commit on %s", current, err, head)
+	}
+	if snapshots, err := ListSnapshots(vaultPath); err != nil || len(snapshots) != 0 {
+		t.Errorf("snapshots = %+v (%v), want none", snapshots, err)
+	}
+}
+
+func TestSwapEntriesRestoresAfterFailedRename(t *testing.T) {
+	tests := []struct {
+		name         string
+		block        bool // the way back of a.md is blocked too
+		wantRestored bool
+	}{
+		{"everything restored", false, true},
+		{"restore blocked", true, false},
+	}
+	for _, tt := range tests {
+		vaultPath := t.TempDir()
+		staging := t.TempDir()
+		newDir, oldDir := filepath.Join(staging, "new"), filepath.Join(staging, "old")
+		writeTestFile(t, vaultPath, "a.md", "previous")
+		writeTestFile(t, vaultPath, "notes/b.md", "previous")
+		writeTestFile(t, newDir, "a.md", "uploaded")
+		// a non-empty notes directory in the way makes moving the vault's notes out fail after a.md was moved
+		writeTestFile(t, oldDir, "notes/in-the-way.md", "x")
+
+		restore, err := swapEntries(vaultPath, newDir, oldDir)
+		if err == nil {
+			t.Fatalf("%s: swapEntries() succeeded, want the rename of notes to fail", tt.name)
+		}
+		if tt.block {
+			writeTestFile(t, vaultPath, "a.md/blocker.md", "x")
+		}
+		if restored := restore(); restored != tt.wantRestored {
+			t.Errorf("%s: restore() = %v, want %v", tt.name, restored, tt.wantRestored)
+		}
+		if data, err := os.ReadFile(filepath.Join(vaultPath, "notes", "b.md")); err != nil || string(data) != "previous" {
+			t.Errorf("%s: notes/b.md = %q (%v), want it untouched", tt.name, data, err)
+		}
+		// whatever could not be moved back stays in oldDir
+		restoredPath := filepath.Join(vaultPath, "a.md")
+		if tt.block {
+			restoredPath = filepath.Join(oldDir, "a.md")
+		}
+		if data, err := os.ReadFile(restoredPath); err != nil || string(data) != "previous" {
+			t.Errorf("%s: %s = %q (%v), want the previous a.md", tt.name, restoredPath, data, err)
+		}
+	}
+}
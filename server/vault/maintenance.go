@@ -0,0 +1,204 @@
+package vault
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+const (
+	// rewritten history is built here before the branch is moved, outside refs/heads so mirrors never see it
+	maintenanceRef        = "refs/yamanaka/maintenance"
+	maintenanceLargeBlobs = 20
+)
+
+// RetentionPolicy decides which commits survive history compaction.
+// Every commit younger than KeepAll is kept, up to Hourly the last commit of each hour,
+// beyond that the last commit of each day. HEAD, tagged commits and merge commits are always kept,
+// a merge commit keeps the merged history (e.g. from upstream sync) reachable.
+type RetentionPolicy struct {
+	KeepAll time.Duration
+	Hourly  time.Duration
+}
+
+// LargeBlob is one file version stored in the history.
+type LargeBlob struct {
+	Path string `json:"path"` // a path the blob was found at
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// MaintenanceReport describes what a maintenance run did, or would do in a dry run.
+type MaintenanceReport struct {
+	DryRun        bool        `json:"dry_run"`
+	Head          string      `json:"head"`
+	NewHead       string      `json:"new_head,omitempty"` // set when history was rewritten
+	CommitsBefore int         `json:"commits_before"`
+	CommitsAfter  int         `json:"commits_after"`
+	TagsMoved     int         `json:"tags_moved"`
+	GitSizeBefore int64       `json:"git_size_before"`
+	GitSizeAfter  int64       `json:"git_size_after,omitempty"`
+	LargeBlobs    []LargeBlob `json:"large_blobs"`
+}
+
+// Maintenance compacts the vault history according to a retention policy and garbage collects the repository.
+type Maintenance struct {
+	vaultPath string
+	policy    RetentionPolicy
+	interval  time.Duration
+	committer *Committer // may be nil
+	upstream  *Upstream  // may be nil
+	mirrors   []string   // names of the mirror remotes that take over rewritten history
+	onRewrite func(MaintenanceReport)
+	runMutex  sync.Mutex
+}
+
+// creates a maintenance scheduler; onRewrite is called after history was rewritten so mirrors can be replaced
+// pushes still queued in committer are committed before compaction, so they keep their device as author
+func NewMaintenance(vaultPath string, policy RetentionPolicy, interval time.Duration, committer *Committer, upstream *Upstream, mirrors []string, onRewrite func(MaintenanceReport)) *Maintenance {
+	return &Maintenance{vaultPath: vaultPath, policy: policy, interval: interval, committer: committer, upstream: upstream, mirrors: mirrors, onRewrite: onRewrite}
+}
+
+// starts running maintenance in the background
+func (m *Maintenance) Start() {
+	slog.Info("maintenance-goroutine: started", "interval", m.interval, "keep all", m.policy.KeepAll, "hourly", m.policy.Hourly)
+	ticker := time.NewTicker(m.interval)
+	go func() {
+		for range ticker.C {
+			report, err := m.Run(false)
+			if err != nil {
+				slog.Error("maintenance-goroutine: maintenance failed", "error", err)
+				continue
+			}
+			slog.Info("maintenance-goroutine: done", "commits before", report.CommitsBefore, "commits after", report.CommitsAfter,
+				"git size before", report.GitSizeBefore, "git size after", report.GitSizeAfter)
+		}
+	}()
+}
+
+// compacts the history and runs gc; a dry run only reports what would be squashed
+func (m *Maintenance) Run(dryRun bool) (MaintenanceReport, error) {
+	m.runMutex.Lock()
+	defer m.runMutex.Unlock()
+	report := MaintenanceReport{DryRun: dryRun}
+	if !dryRun && m.upstream != nil {
+		// ingest upstream commits first, they could not be merged into rewritten history afterwards
+		if _, err := m.upstream.Sync(); err != nil {
+			slog.Warn("maintenance-goroutine: upstream sync before compaction failed", "error", err)
+		}
+	}
+	if !dryRun {
+		m.committer.Flush()
+	}
+	repo, err := OpenRepo(m.vaultPath)
+	if err != nil {
+		return report, err
+	}
+	report.GitSizeBefore = dirSize(filepath.Join(m.vaultPath, ".git"))
+
+	if err := m.compact(repo, &report); err != nil {
+		return report, err
+	}
+	if report.NewHead != "" && m.onRewrite != nil {
+		m.onRewrite(report)
+	}
+	if !dryRun {
+		// gc only needs the repository lock, pushes can write files meanwhile
+		if err := repo.GC(); err != nil {
+			return report, err
+		}
+		report.GitSizeAfter = dirSize(filepath.Join(m.vaultPath, ".git"))
+	}
+	if report.LargeBlobs, err = repo.LargeBlobs(maintenanceLargeBlobs); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func (m *Maintenance) compact(repo Repo, report *MaintenanceReport) error {
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	var err error
+	if report.DryRun {
+		report.Head, err = repo.Head()
+	} else {
+		report.Head, err = repo.CommitAll("Commit before maintenance", nil)
+	}
+	if err != nil || report.Head == "" {
+		return err
+	}
+	chain, err := repo.FirstParentLog()
+	if err != nil {
+		return err
+	}
+	tagged, err := repo.TaggedCommits()
+	if err != nil {
+		return err
+	}
+	keep := m.policy.selectCommits(chain, tagged, time.Now())
+	report.CommitsBefore = len(chain)
+	report.CommitsAfter = len(keep)
+	if report.DryRun || len(keep) == len(chain) {
+		return nil
+	}
+
+	newHead, rewritten, err := repo.RewriteHistory(keep, maintenanceRef)
+	if err != nil {
+		return err
+	}
+	if err := recordRewrite(m.vaultPath, chain, rewritten, m.mirrors, m.upstream != nil); err != nil {
+		return fmt.Errorf("could not record the history rewrite: %w", err)
+	}
+	if report.TagsMoved, err = repo.ApplyRewrite(newHead, rewritten, maintenanceRef); err != nil {
+		return err
+	}
+	report.NewHead = newHead
+	slog.Info("maintenance-goroutine: history compacted", "old head", report.Head, "new head", newHead,
+		"commits before", report.CommitsBefore, "commits after", report.CommitsAfter)
+	return nil
+}
+
+// picks the commits to keep from a first-parent chain (newest first)
+func (p RetentionPolicy) selectCommits(chain []CommitInfo, tagged map[string][]string, now time.Time) map[string]bool {
+	keep := make(map[string]bool)
+	seenBuckets := make(map[string]bool)
+	for i, commit := range chain {
+		age := now.Sub(commit.When)
+		var bucket string
+		switch {
+		case i == 0 || age <= p.KeepAll || len(tagged[commit.Hash]) > 0 || commit.Merge:
+			keep[commit.Hash] = true
+			continue
+		case age <= p.Hourly:
+			bucket = "hour " + commit.When.UTC().Format("2006-01-02T15")
+		default:
+			bucket = "day " + commit.When.UTC().Format("2006-01-02")
+		}
+		// newest first, so the first commit seen in a bucket is the last one made in it
+		if !seenBuckets[bucket] {
+			seenBuckets[bucket] = true
+			keep[commit.Hash] = true
+		}
+	}
+	return keep
+}
+
+// total size of the files below a directory
+func dirSize(root string) int64 {
+	var size int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,165 @@
+package vault
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestSelectCommits(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	policy := RetentionPolicy{KeepAll: 24 * time.Hour, Hourly: 7 * 24 * time.Hour}
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name   string
+		chain  []CommitInfo // newest first
+		tagged map[string][]string
+		want   []string
+	}{
+		{
+			name:  "recent commits are all kept",
+			chain: []CommitInfo{{Hash: "c3", When: ago(time.Minute)}, {Hash: "c2", When: ago(time.Hour)}, {Hash: "c1", When: ago(23 * time.Hour)}},
+			want:  []string{"c1", "c2", "c3"},
+		},
+		{
+			name: "last commit of each hour",
+			chain: []CommitInfo{
+				{Hash: "head", When: ago(time.Minute)},
+				{Hash: "h2-late", When: time.Date(2026, 3, 8, 10, 50, 0, 0, time.UTC)},
+				{Hash: "h2-early", When: time.Date(2026, 3, 8, 10, 5, 0, 0, time.UTC)},
+				{Hash: "h1", When: time.Date(2026, 3, 8, 9, 59, 0, 0, time.UTC)},
+			},
+			want: []string{"h1", "h2-late", "head"},
+		},
+		{
+			name: "last commit of each day beyond the hourly window",
+			chain: []CommitInfo{
+				{Hash: "head", When: ago(time.Minute)},
+				{Hash: "d2-late", When: time.Date(2026, 2, 1, 23, 0, 0, 0, time.UTC)},
+				{Hash: "d2-early", When: time.Date(2026, 2, 1, 1, 0, 0, 0, time.UTC)},
+				{Hash: "d1", When: time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)},
+			},
+			want: []string{"d1", "d2-late", "head"},
+		},
+		{
+			name: "tagged commits survive",
+			chain: []CommitInfo{
+				{Hash: "head", When: ago(time.Minute)},
+				{Hash: "late", When: time.Date(2026, 2, 1, 23, 0, 0, 0, time.UTC)},
+				{Hash: "tagged", When: time.Date(2026, 2, 1, 1, 0, 0, 0, time.UTC)},
+			},
+			tagged: map[string][]string{"tagged": {"snapshot/before-import"}},
+			want:   []string{"head", "late", "tagged"},
+		},
+		{
+			name: "merge commits survive",
+			chain: []CommitInfo{
+				{Hash: "head", When: ago(time.Minute)},
+				{Hash: "late", When: time.Date(2026, 2, 1, 23, 0, 0, 0, time.UTC)},
+				{Hash: "merge", When: time.Date(2026, 2, 1, 1, 0, 0, 0, time.UTC), Merge: true},
+			},
+			want: []string{"head", "late", "merge"},
+		},
+		{
+			name:  "head is kept however old",
+			chain: []CommitInfo{{Hash: "head", When: ago(400 * 24 * time.Hour)}},
+			want:  []string{"head"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := policy.selectCommits(tt.chain, tt.tagged, now)
+			var got []string
+			for hash := range keep {
+				got = append(got, hash)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectCommits() kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceCommitsQueuedPushesFirst(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	commitFile(t, vaultPath, repo, "a.md", "one")
+	commitFile(t, vaultPath, repo, "a.md", "two")
+	committer := NewCommitter(vaultPath, time.Hour, time.Hour, nil)
+	writeTestFile(t, vaultPath, "pushed.md", "from the phone")
+	committer.Enqueue(phonePush("pushed.md"))
+
+	report, err := NewMaintenance(vaultPath, RetentionPolicy{}, time.Hour, committer, nil, nil, nil).Run(false)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.NewHead == "" {
+		t.Fatalf("report = %+v, want a rewritten history", report)
+	}
+	commits, err := repo.FirstParentLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits[0].AuthorName != "Phone" {
+		t.Errorf("head commit by %s (%q), want the queued phone push", commits[0].AuthorName, commits[0].Message)
+	}
+}
+
+func TestCompactionKeepsMergedHistory(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	commitFile(t, vaultPath, repo, "a.md", "base")
+	remote, checkout := newTestUpstream(t, vaultPath, repo)
+	laptopHash := laptopCommit(t, checkout, "laptop.md", "from the laptop")
+	commitFile(t, vaultPath, repo, "server.md", "from the server")
+	upstream := NewUpstream(vaultPath, remote, "master", time.Hour, nil, nil)
+	if result, err := upstream.Sync(); err != nil || result.Mode != "merge" {
+		t.Fatalf("Sync() = %+v, %v, want a merge", result, err)
+	}
+	commitFile(t, vaultPath, repo, "a.md", "after the merge")
+
+	report, err := NewMaintenance(vaultPath, RetentionPolicy{}, time.Hour, nil, upstream, nil, nil).Run(false)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.NewHead == "" {
+		t.Fatalf("report = %+v, want a rewritten history", report)
+	}
+	if base, err := repo.MergeBase(laptopHash, report.NewHead); err != nil || base != laptopHash {
+		t.Errorf("the upstream commit is no longer part of the history: base %s, %v", base, err)
+	}
+	if wasReplaced(vaultPath, laptopHash) {
+		t.Errorf("the upstream commit was recorded as replaced")
+	}
+	repository, err := git.PlainOpen(vaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merges := 0
+	commits, err := repository.Log(&git.LogOptions{From: plumbing.NewHash(report.NewHead)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits.ForEach(func(commit *object.Commit) error {
+		if commit.NumParents() > 1 {
+			merges++
+			if commit.ParentHashes[1].String() != laptopHash {
+				t.Errorf("merge parents = %v, want the upstream commit %s second", commit.ParentHashes, laptopHash)
+			}
+		}
+		return nil
+	})
+	if merges != 1 {
+		t.Errorf("%d merge commits after compaction, want 1", merges)
+	}
+
+	// nothing new upstream, the merge is not redone
+	if result, err := upstream.Sync(); err != nil || result.Mode != "up-to-date" {
+		t.Errorf("Sync() after compaction = %+v, %v, want up-to-date", result, err)
+	}
+}
@@ -0,0 +1,276 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+// ConflictPolicy decides what happens to a file that differs between the vault and an incoming copy.
+type ConflictPolicy string
+
+const (
+	ConflictKeepBoth   ConflictPolicy = "keep-both"   // the vault version stays, the incoming one is saved as a conflict copy
+	ConflictServerWins ConflictPolicy = "server-wins" // the incoming version is dropped
+	ConflictClientWins ConflictPolicy = "client-wins" // the incoming version replaces the vault's
+)
+
+// parses a conflict policy, empty means ConflictKeepBoth
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(value); policy {
+	case "":
+		return ConflictKeepBoth, nil
+	case ConflictKeepBoth, ConflictServerWins, ConflictClientWins:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", value)
+}
+
+// MergeAction is what a merge did with one path.
+type MergeAction string
+
+const (
+	MergeAdded      MergeAction = "added"       // only on the client, added to the vault
+	MergeServerOnly MergeAction = "server_only" // only on the server, kept
+	MergeIdentical  MergeAction = "identical"
+	MergeKeptServer MergeAction = "kept_server" // differed, the server version was kept
+	MergeReplaced   MergeAction = "replaced"    // differed, the client version was taken
+	MergeKeptBoth   MergeAction = "kept_both"   // differed, the client version was saved as ConflictCopy
+)
+
+// MergeEntry reports the outcome for one path.
+type MergeEntry struct {
+	Path         string      `json:"path"`
+	Action       MergeAction `json:"action"`
+	ConflictCopy string      `json:"conflict_copy,omitempty"`
+}
+
+// MergeResult describes an initial sync merged into the vault.
+type MergeResult struct {
+	Hash    string       `json:"hash"`
+	Policy  string       `json:"policy"`
+	Paths   []MergeEntry `json:"paths"`
+	Changes []PathChange `json:"-"` // vault files that were added or changed
+}
+
+// merges the files of a gzipped tarball into the vault without removing anything
+// files that differ are resolved with policy, conflict copies are named after label (e.g. the device)
+// if applying fails half way, the files written so far are reverted
+func MergeVault(vaultPath string, archive io.Reader, policy ConflictPolicy, label, message string, author *CommitAuthor) (MergeResult, error) {
+	result := MergeResult{Policy: string(policy), Paths: []MergeEntry{}}
+	staging, err := newStaging(vaultPath)
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(staging)
+	newDir := filepath.Join(staging, "new")
+	hashes, err := ExtractTarGz(archive, newDir)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return result, err
+	}
+	if _, err := repo.CommitAll("Pre-merge snapshot", nil); err != nil {
+		return result, err
+	}
+
+	serverOnly, err := serverOnlyFiles(vaultPath, hashes)
+	if err != nil {
+		return result, err
+	}
+
+	var undo []func()
+	revert := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	paths := make([]string, 0, len(hashes))
+	for relPath := range hashes {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+	for _, relPath := range paths {
+		entry, err := mergeFile(vaultPath, newDir, relPath, hashes[relPath], policy, label, &undo)
+		if err != nil {
+			revert()
+			return result, fmt.Errorf("failed to merge %s: %w", relPath, err)
+		}
+		result.Paths = append(result.Paths, entry)
+		switch entry.Action {
+		case MergeAdded:
+			result.Changes = append(result.Changes, PathChange{Path: relPath, Action: ChangeAdded})
+		case MergeReplaced:
+			result.Changes = append(result.Changes, PathChange{Path: relPath, Action: ChangeModified})
+		case MergeKeptBoth:
+			result.Changes = append(result.Changes, PathChange{Path: entry.ConflictCopy, Action: ChangeAdded})
+		}
+	}
+
+	for _, relPath := range serverOnly {
+		result.Paths = append(result.Paths, MergeEntry{Path: relPath, Action: MergeServerOnly})
+	}
+	if result.Hash, err = repo.CommitAll(message, author); err != nil {
+		revert()
+		return result, err
+	}
+	return result, nil
+}
+
+// applies one incoming file and records how to undo it
+func mergeFile(vaultPath, newDir, relPath, hash string, policy ConflictPolicy, label string, undo *[]func()) (MergeEntry, error) {
+	entry := MergeEntry{Path: relPath}
+	incoming := filepath.Join(newDir, filepath.FromSlash(relPath))
+	target := filepath.Join(vaultPath, filepath.FromSlash(relPath))
+
+	info, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		entry.Action = MergeAdded
+		return entry, moveIncoming(vaultPath, incoming, relPath, hash, undo)
+	}
+	if err != nil && !errors.Is(err, syscall.ENOTDIR) {
+		return entry, err
+	}
+	if err == nil && !info.IsDir() {
+		existing, err := os.ReadFile(target)
+		if err != nil {
+			return entry, err
+		}
+		sum := sha256.Sum256(existing)
+		if hex.EncodeToString(sum[:]) == hash {
+			entry.Action = MergeIdentical
+			return entry, nil
+		}
+		switch policy {
+		case ConflictServerWins:
+			entry.Action = MergeKeptServer
+			return entry, nil
+		case ConflictClientWins:
+			entry.Action = MergeReplaced
+			*undo = append(*undo, func() {
+				noteServerWrite(relPath, existing)
+				if err := os.WriteFile(target, existing, info.Mode().Perm()); err != nil {
+					slog.Error("merge: could not restore file", "path", relPath, "error", err)
+				}
+			})
+			noteServerHash(relPath, hash)
+			return entry, os.Rename(incoming, target)
+		}
+	}
+	// keep both, also used when a directory is in the way of the incoming file or a file is in the way of its directory
+	entry.Action = MergeKeptBoth
+	var exists bool
+	entry.ConflictCopy, exists = conflictCopyFor(vaultPath, relPath, "conflict "+label, hash)
+	if exists {
+		return entry, nil // a retried upload, the copy is already there
+	}
+	return entry, moveIncoming(vaultPath, incoming, entry.ConflictCopy, hash, undo)
+}
+
+// moves a staged file to a new vault path
+func moveIncoming(vaultPath, incoming, relPath, hash string, undo *[]func()) error {
+	target := filepath.Join(vaultPath, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	noteServerHash(relPath, hash)
+	if err := os.Rename(incoming, target); err != nil {
+		return err
+	}
+	*undo = append(*undo, func() {
+		noteServerRemove(relPath)
+		if err := os.Remove(target); err != nil {
+			slog.Error("merge: could not remove added file", "path", relPath, "error", err)
+		}
+	})
+	return nil
+}
+
+// the conflict copy path for content with the given hash: an existing copy with the same content,
+// or the first numbered path that is not taken yet
+// when a file is where a parent directory of relPath should be, the copy goes below a renamed copy of that path
+// ("a/b.md" with a file "a" -> "a (conflict x)/b.md")
+func conflictCopyFor(vaultPath, relPath, label, hash string) (string, bool) {
+	copyPath := func(label string) string {
+		return conflictCopyPath(relPath, label)
+	}
+	if blocked := blockingFile(vaultPath, relPath); blocked != "" {
+		copyPath = func(label string) string {
+			return conflictCopyPath(blocked, label) + strings.TrimPrefix(relPath, blocked)
+		}
+	}
+	candidate := copyPath(label)
+	for n := 2; ; n++ {
+		content, err := os.ReadFile(filepath.Join(vaultPath, filepath.FromSlash(candidate)))
+		if os.IsNotExist(err) {
+			return candidate, false
+		}
+		if err == nil {
+			if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) == hash {
+				return candidate, true
+			}
+		}
+		candidate = copyPath(label + " " + strconv.Itoa(n))
+	}
+}
+
+// the closest ancestor of relPath that is a file in the vault, "" when there is none
+func blockingFile(vaultPath, relPath string) string {
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		prefix := path.Join(parts[:i]...)
+		info, err := os.Stat(filepath.Join(vaultPath, filepath.FromSlash(prefix)))
+		if err != nil {
+			return ""
+		}
+		if !info.IsDir() {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// vault files that are not part of incoming, sorted
+func serverOnlyFiles(vaultPath string, incoming map[string]string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(vaultPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(vaultPath, path)
+		relPath = filepath.ToSlash(relPath)
+		if relPath == "." {
+			return nil
+		}
+		if isReservedPath(relPath) || isInternalPath(relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := incoming[relPath]; !ok && !d.IsDir() {
+			paths = append(paths, relPath)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
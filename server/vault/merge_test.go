@@ -0,0 +1,129 @@
+package vault
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// builds a gzipped tarball holding files
+func testArchive(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestMergeVaultPolicies(t *testing.T) {
+	server := map[string]string{
+		"same.md":   "same",
+		"differ.md": "server",
+		"a":         "a file where the client has a directory",
+		"d/x.md":    "a directory where the client has a file",
+		"server.md": "only on the server",
+	}
+	incoming := map[string]string{
+		"same.md":   "same",
+		"differ.md": "client",
+		"new.md":    "new",
+		"a/b.md":    "below a",
+		"d":         "file d",
+	}
+	type outcome struct {
+		action MergeAction
+		copy   string
+	}
+	// a file in the way of a directory, or the other way round, is always kept as a copy
+	blocked := map[string]outcome{
+		"a/b.md": {MergeKeptBoth, "a (conflict phone)/b.md"},
+		"d":      {MergeKeptBoth, "d (conflict phone)"},
+	}
+
+	tests := []struct {
+		policy     ConflictPolicy
+		differ     outcome
+		wantDiffer string // content of differ.md after the merge
+	}{
+		{ConflictKeepBoth, outcome{MergeKeptBoth, "differ (conflict phone).md"}, "server"},
+		{ConflictServerWins, outcome{MergeKeptServer, ""}, "server"},
+		{ConflictClientWins, outcome{MergeReplaced, ""}, "client"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			vaultPath, repo := newTestVault(t)
+			for relPath, content := range server {
+				writeTestFile(t, vaultPath, relPath, content)
+			}
+			if _, err := repo.CommitAll("server files", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := MergeVault(vaultPath, testArchive(t, incoming), tt.policy, "phone", "merge", nil)
+			if err != nil {
+				t.Fatalf("MergeVault: %v", err)
+			}
+			want := map[string]outcome{
+				"same.md":   {MergeIdentical, ""},
+				"differ.md": tt.differ,
+				"new.md":    {MergeAdded, ""},
+				"a":         {MergeServerOnly, ""},
+				"d/x.md":    {MergeServerOnly, ""},
+				"server.md": {MergeServerOnly, ""},
+			}
+			for relPath, o := range blocked {
+				want[relPath] = o
+			}
+			got := make(map[string]outcome)
+			for _, entry := range result.Paths {
+				got[entry.Path] = outcome{entry.Action, entry.ConflictCopy}
+			}
+			for relPath, o := range want {
+				if got[relPath] != o {
+					t.Errorf("%s: got %+v, want %+v", relPath, got[relPath], o)
+				}
+			}
+			if len(got) != len(want) {
+				t.Errorf("got %d entries, want %d: %+v", len(got), len(want), result.Paths)
+			}
+
+			expectFiles := map[string]string{"differ.md": tt.wantDiffer, "new.md": "new", "a (conflict phone)/b.md": "below a", "d (conflict phone)": "file d"}
+			if tt.differ.copy != "" {
+				expectFiles[tt.differ.copy] = "client"
+			}
+			for relPath, content := range expectFiles {
+				data, err := os.ReadFile(filepath.Join(vaultPath, filepath.FromSlash(relPath)))
+				if err != nil || string(data) != content {
+					t.Errorf("%s = %q (%v), want %q", relPath, data, err, content)
+				}
+			}
+			if head, _ := repo.Head(); head != result.Hash {
+				t.Errorf("HEAD = %s, want the merge commit %s", head, result.Hash)
+			}
+		})
+	}
+}
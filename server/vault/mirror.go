@@ -0,0 +1,227 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorMaxAttempts  = 5
+	mirrorBaseBackoff  = 2 * time.Second
+	mirrorMaxBackoff   = 2 * time.Minute
+	mirrorPollInterval = time.Minute // catches commits made without a Notify (periodic, rollback)
+)
+
+// errMirrorAhead stops a forced push that would drop mirror commits the vault does not have
+var errMirrorAhead = errors.New("mirror has commits the vault does not have, not overwriting them")
+
+// MirrorStatus reports the push state of one mirror remote.
+type MirrorStatus struct {
+	Name           string    `json:"name"`
+	URL            string    `json:"url"`
+	LastPushedHash string    `json:"last_pushed_hash,omitempty"`
+	LastSuccess    time.Time `json:"last_success,omitzero"`
+	LastAttempt    time.Time `json:"last_attempt,omitzero"`
+	LastError      string    `json:"last_error,omitempty"`
+	FailedAttempts int       `json:"failed_attempts"`
+	PushInProgress bool      `json:"push_in_progress"`
+}
+
+// Mirror pushes the vault history to one or more remotes in the background.
+// Each remote has its own worker, so a failing remote never delays the others or the vault.
+type Mirror struct {
+	vaultPath string
+	workers   []*mirrorWorker
+}
+
+type mirrorWorker struct {
+	vaultPath string
+	remote    Remote
+	trigger   chan struct{}
+	mutex     sync.Mutex
+	status    MirrorStatus
+}
+
+// creates a mirror for the given remotes, remotes without a name are named after their position
+func NewMirror(vaultPath string, remotes []Remote) *Mirror {
+	m := &Mirror{vaultPath: vaultPath}
+	for i, remote := range remotes {
+		if remote.Name == "" {
+			remote.Name = "mirror-" + strconv.Itoa(i+1)
+		}
+		m.workers = append(m.workers, &mirrorWorker{
+			vaultPath: vaultPath,
+			remote:    remote,
+			trigger:   make(chan struct{}, 1),
+			status:    MirrorStatus{Name: remote.Name, URL: remote.RedactedURL()},
+		})
+	}
+	return m
+}
+
+// returns the names of the remotes
+func (m *Mirror) Names() []string {
+	names := make([]string, 0, len(m.workers))
+	for _, w := range m.workers {
+		names = append(names, w.remote.Name)
+	}
+	return names
+}
+
+// starts one background worker per remote
+func (m *Mirror) Start() {
+	for _, w := range m.workers {
+		slog.Info("mirror-goroutine: started", "remote", w.remote.Name, "url", w.remote.RedactedURL())
+		go w.run()
+	}
+}
+
+// asks every remote to push the latest history, never blocks
+func (m *Mirror) Notify() {
+	for _, w := range m.workers {
+		select {
+		case w.trigger <- struct{}{}:
+		default: // a push is already pending and will include this commit
+		}
+	}
+}
+
+// asks every remote to take over rewritten history
+// compaction already recorded the rewrite, so the next push of each remote is forced, even after a restart
+func (m *Mirror) NotifyRewrite() {
+	for _, w := range m.workers {
+		w.mutex.Lock()
+		w.status.LastPushedHash = ""
+		w.mutex.Unlock()
+	}
+	m.Notify()
+}
+
+// returns the current state of every remote
+func (m *Mirror) Status() []MirrorStatus {
+	statuses := make([]MirrorStatus, 0, len(m.workers))
+	for _, w := range m.workers {
+		w.mutex.Lock()
+		statuses = append(statuses, w.status)
+		w.mutex.Unlock()
+	}
+	return statuses
+}
+
+func (w *mirrorWorker) run() {
+	ticker := time.NewTicker(mirrorPollInterval)
+	defer ticker.Stop()
+	w.sync() // bring the remote up to date after a restart
+	for {
+		select {
+		case <-w.trigger:
+		case <-ticker.C:
+		}
+		w.sync()
+	}
+}
+
+// pushes HEAD if the remote is behind, retrying with exponential backoff
+func (w *mirrorWorker) sync() {
+	head, err := GetCurrentHash(w.vaultPath)
+	if err != nil || head == "" {
+		return
+	}
+	w.mutex.Lock()
+	upToDate := w.status.LastPushedHash == head
+	w.mutex.Unlock()
+	if upToDate {
+		return
+	}
+	forceGeneration := pendingForcePush(w.vaultPath, w.remote.Name)
+	force := forceGeneration > 0
+
+	repo, err := OpenRepo(w.vaultPath)
+	if err != nil {
+		return
+	}
+	backoff := mirrorBaseBackoff
+	for attempt := 1; attempt <= mirrorMaxAttempts; attempt++ {
+		w.mutex.Lock()
+		w.status.PushInProgress = true
+		w.status.LastAttempt = time.Now().UTC()
+		w.mutex.Unlock()
+
+		var err error
+		if force {
+			err = checkMirrorLease(w.vaultPath, repo, w.remote)
+		}
+		if errors.Is(err, errMirrorAhead) {
+			w.mutex.Lock()
+			w.status.PushInProgress = false
+			w.status.LastError = err.Error()
+			w.status.FailedAttempts++
+			w.mutex.Unlock()
+			// retrying cannot help, someone has to bring those commits into the vault or drop them
+			slog.Error("mirror-goroutine: forced push refused", "remote", w.remote.Name, "error", err)
+			return
+		}
+		if err == nil {
+			err = repo.Push(w.remote, force)
+		}
+
+		w.mutex.Lock()
+		w.status.PushInProgress = false
+		if err == nil {
+			w.status.LastPushedHash = head
+			w.status.LastSuccess = time.Now().UTC()
+			w.status.LastError = ""
+			w.status.FailedAttempts = 0
+			w.mutex.Unlock()
+			if force {
+				if err := recordForcePush(w.vaultPath, w.remote.Name, forceGeneration); err != nil {
+					slog.Error("mirror-goroutine: could not record the forced push", "remote", w.remote.Name, "error", err)
+				}
+			}
+			slog.Info("mirror-goroutine: pushed", "remote", w.remote.Name, "hash", head, "forced", force)
+			return
+		}
+		w.status.LastError = err.Error()
+		w.status.FailedAttempts++
+		w.mutex.Unlock()
+		slog.Warn("mirror-goroutine: push failed", "remote", w.remote.Name, "attempt", attempt, "error", err)
+
+		if attempt == mirrorMaxAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, mirrorMaxBackoff)
+	}
+	slog.Error("mirror-goroutine: giving up until the next commit or poll", "remote", w.remote.Name)
+}
+
+// lets a forced push through only when it replaces history the vault had itself: each branch the push
+// updates has to point to a commit compaction replaced or to one in the current history
+// a commit pushed to the mirror by someone else since then would otherwise be lost
+func checkMirrorLease(vaultPath string, repo Repo, remote Remote) error {
+	branches, err := repo.RemoteBranches(remote)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	for name, hash := range branches {
+		if _, err := repo.Resolve("refs/heads/" + name); err != nil {
+			continue // not pushed, a branch only the mirror has is left alone
+		}
+		if wasReplaced(vaultPath, hash) {
+			continue
+		}
+		if base, err := repo.MergeBase(hash, head); err == nil && base == hash {
+			continue
+		}
+		return fmt.Errorf("%w: branch %s is at %s", errMirrorAhead, name, hash)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package vault
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// compacts the vault history down to its tip, the way maintenance does with the given mirrors
+func fakeCompaction(t *testing.T, vaultPath string, repo Repo, mirrors ...string) string {
+	t.Helper()
+	chain, err := repo.FirstParentLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep := map[string]bool{chain[0].Hash: true}
+	newHead, rewritten, err := repo.RewriteHistory(keep, maintenanceRef)
+	if err != nil {
+		t.Fatalf("RewriteHistory: %v", err)
+	}
+	if err := recordRewrite(vaultPath, chain, rewritten, mirrors, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.ApplyRewrite(newHead, rewritten, maintenanceRef); err != nil {
+		t.Fatalf("ApplyRewrite: %v", err)
+	}
+	return newHead
+}
+
+func mirrorHead(t *testing.T, barePath string) string {
+	t.Helper()
+	bare, err := git.PlainOpen(barePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := bare.Reference("refs/heads/master", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref.Hash().String()
+}
+
+func TestForcedMirrorPushKeepsForeignCommits(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	commitFile(t, vaultPath, repo, "a.md", "one")
+	commitFile(t, vaultPath, repo, "a.md", "two")
+	remote, checkout := newTestUpstream(t, vaultPath, repo)
+	remote.Name = "mirror"
+	mirror := NewMirror(vaultPath, []Remote{remote})
+	worker := mirror.workers[0]
+
+	// someone pushes to the mirror, then the vault history is compacted before that commit was ingested
+	laptopHash := laptopCommit(t, checkout, "laptop.md", "only on the mirror")
+	newHead := fakeCompaction(t, vaultPath, repo, "mirror")
+	mirror.NotifyRewrite()
+	worker.sync()
+	if got := mirrorHead(t, remote.URL); got != laptopHash {
+		t.Fatalf("mirror at %s, want the laptop commit %s kept", got, laptopHash)
+	}
+	status := mirror.Status()[0]
+	if !strings.Contains(status.LastError, errMirrorAhead.Error()) || status.LastPushedHash != "" {
+		t.Errorf("status = %+v, want the refused forced push reported", status)
+	}
+	if pendingForcePush(vaultPath, "mirror") == 0 {
+		t.Errorf("the forced push is no longer pending")
+	}
+
+	// once the mirror is back at history the vault had, the forced push goes through
+	if err := checkMirrorLease(vaultPath, repo, remote); !errors.Is(err, errMirrorAhead) {
+		t.Errorf("checkMirrorLease() = %v, want errMirrorAhead", err)
+	}
+	laptop, err := git.PlainOpen(checkout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptopCommitObject, err := laptop.CommitObject(plumbing.NewHash(laptopHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.Storer.SetReference(plumbing.NewHashReference("refs/heads/master", laptopCommitObject.ParentHashes[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.Push(&git.PushOptions{RefSpecs: []config.RefSpec{"+refs/heads/master:refs/heads/master"}}); err != nil {
+		t.Fatalf("reset the mirror: %v", err)
+	}
+	worker.sync()
+	if got := mirrorHead(t, remote.URL); got != newHead {
+		t.Errorf("mirror at %s, want the compacted head %s", got, newHead)
+	}
+	if status := mirror.Status()[0]; status.LastError != "" || status.LastPushedHash != newHead {
+		t.Errorf("status = %+v, want a successful push of %s", status, newHead)
+	}
+	if generation := pendingForcePush(vaultPath, "mirror"); generation != 0 {
+		t.Errorf("forced push to generation %d still pending", generation)
+	}
+}
@@ -0,0 +1,80 @@
+package vault
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Remote is a git remote the vault history is exchanged with.
+// URLs can be local paths (e.g. a bare repository), file://, ssh:// or scp-style (git@host:repo.git) and https://.
+type Remote struct {
+	Name       string
+	URL        string
+	Username   string // HTTPS basic auth user, "git" for SSH when empty
+	Password   string // HTTPS password or access token
+	SSHKeyPath string // private key for SSH remotes; host keys are checked against SSH_KNOWN_HOSTS or ~/.ssh/known_hosts
+	SSHKeyPass string
+}
+
+// returns a remote URL with any credentials removed, safe for logs, status output and printed configuration
+// a URL that does not parse is masked entirely, scp-style remotes carry no password and are kept
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		if endpoint, err := transport.NewEndpoint(raw); err == nil && endpoint.Password == "" {
+			return raw
+		}
+		return "********"
+	}
+	if u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// returns the remote URL with any credentials removed, see RedactURL
+func (r Remote) RedactedURL() string {
+	return RedactURL(r.URL)
+}
+
+// builds the go-git auth method for a remote, nil for local and anonymous remotes
+func (r Remote) auth() (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(r.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote url %s: %w", r.RedactedURL(), err)
+	}
+	switch strings.ToLower(endpoint.Protocol) {
+	case "ssh":
+		if r.SSHKeyPath == "" {
+			return nil, nil // fall back to the SSH agent
+		}
+		user := r.Username
+		if user == "" {
+			user = endpoint.User
+		}
+		if user == "" {
+			user = "git"
+		}
+		keys, err := ssh.NewPublicKeysFromFile(user, r.SSHKeyPath, r.SSHKeyPass)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ssh key %s: %w", r.SSHKeyPath, err)
+		}
+		return keys, nil
+	case "http", "https":
+		if r.Password == "" {
+			return nil, nil
+		}
+		user := r.Username
+		if user == "" {
+			user = "yamanaka" // most forges only look at the token
+		}
+		return &http.BasicAuth{Username: user, Password: r.Password}, nil
+	}
+	return nil, nil
+}
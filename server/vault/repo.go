@@ -0,0 +1,1133 @@
+package vault
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// identity used as committer for every commit, and as author when no device is known
+var defaultSignature = CommitAuthor{Name: "yamanaka", Email: "yamanaka@obsidian.sync"}
+
+// ChangeAction is how a path changed between two revisions.
+type ChangeAction string
+
+const (
+	ChangeAdded    ChangeAction = "added"
+	ChangeModified ChangeAction = "modified"
+	ChangeDeleted  ChangeAction = "deleted"
+)
+
+// PathChange is one file that differs between two revisions.
+type PathChange struct {
+	Path   string       `json:"path"`
+	Action ChangeAction `json:"action"`
+}
+
+// CommitInfo summarizes a commit for history listings.
+type CommitInfo struct {
+	Hash        string    `json:"hash"`
+	AuthorName  string    `json:"author_name"`
+	AuthorEmail string    `json:"author_email"`
+	When        time.Time `json:"when"`
+	Message     string    `json:"message"`
+	Merge       bool      `json:"merge,omitempty"` // has more than one parent
+}
+
+// TagInfo describes an annotated tag.
+type TagInfo struct {
+	Name        string
+	Hash        string // the tagged commit
+	TaggerName  string
+	TaggerEmail string
+	When        time.Time
+	Message     string
+}
+
+// LogOptions narrows down Repo.Log.
+type LogOptions struct {
+	From  string    // revision to start from, HEAD when empty
+	Until time.Time // only commits made at or before this time, ignored when zero
+	Limit int       // maximum number of commits, unlimited when zero
+}
+
+// Repo is the git layer behind the vault history.
+// Writes are expected to be serialized by the caller (state.FileSystemMutex).
+type Repo interface {
+	// Head returns the commit HEAD points to, or "" before the first commit.
+	Head() (string, error)
+	// Resolve turns a revision (hash, branch, tag, HEAD~n) into a commit hash.
+	Resolve(rev string) (string, error)
+	// CommitAll stages every change in the worktree and commits it.
+	// When there is nothing to commit it returns the current HEAD.
+	CommitAll(message string, author *CommitAuthor) (string, error)
+	// CommitPaths stages only the given files, or the files under a given directory that is gone,
+	// and commits them. Other changes in the worktree stay uncommitted.
+	// When there is nothing to commit it returns the current HEAD.
+	CommitPaths(paths []string, message string, author *CommitAuthor) (string, error)
+	// Log lists commits, newest first.
+	Log(opts LogOptions) ([]CommitInfo, error)
+	// ReadFile returns a file's content at a revision; exists is false when the file is not in it.
+	ReadFile(rev, relPath string) (content []byte, exists bool, err error)
+	// ListFiles lists the files of a revision below a directory ("" for all of them).
+	ListFiles(rev, dir string) ([]string, error)
+	// ChangedPaths lists the files that differ between two revisions.
+	ChangedPaths(from, to string) ([]PathChange, error)
+	// DiffFile returns the unified diff of one file between two revisions.
+	DiffFile(from, to, relPath string) (string, error)
+	// CheckoutFiles makes a clean worktree match a revision without moving HEAD.
+	// Paths for which skip returns true are left untouched.
+	CheckoutFiles(rev string, skip func(relPath string) bool) error
+	// Push sends all branches and tags to a remote; being up to date is not an error.
+	// force is needed once after history was rewritten by compaction.
+	Push(remote Remote, force bool) error
+	// Fetch downloads a branch of a remote and returns the commit it points to.
+	Fetch(remote Remote, branch string) (string, error)
+	// RemoteBranches lists the branches of a remote and the commits they point to, without fetching them.
+	RemoteBranches(remote Remote) (map[string]string, error)
+	// MergeBase returns the best common ancestor of two revisions, "" when they share no history.
+	MergeBase(a, b string) (string, error)
+	// SetHead moves the current branch to a commit without touching the worktree or index.
+	SetHead(hash string) error
+	// CommitMerge stages every change and records a merge commit of HEAD and other.
+	CommitMerge(message string, author *CommitAuthor, other string) (string, error)
+	// FirstParentLog lists the first-parent chain of HEAD, newest first.
+	FirstParentLog() ([]CommitInfo, error)
+	// TaggedCommits maps every tagged commit to the names of its tags.
+	TaggedCommits() (map[string][]string, error)
+	// RewriteHistory recreates the first-parent chain of HEAD with only the commits in keep, the changes of
+	// dropped commits fold into the next kept one. A kept merge commit keeps its other parents, so merged
+	// history (e.g. from upstream) stays reachable. The new tip is stored under ref, HEAD does not move.
+	// It returns the new tip and the old hash -> new hash mapping of every kept commit.
+	RewriteHistory(keep map[string]bool, ref string) (string, map[string]string, error)
+	// ApplyRewrite moves the current branch and the affected tags to rewritten commits and drops ref and
+	// remote-tracking branches, so the replaced history becomes unreachable. It returns the tags moved.
+	ApplyRewrite(newHead string, rewritten map[string]string, ref string) (int, error)
+	// GC repacks every reachable object into one pack and deletes unreachable loose objects.
+	GC() error
+	// LargeBlobs lists the biggest blobs reachable from any ref, largest first.
+	LargeBlobs(limit int) ([]LargeBlob, error)
+	// CreateTag creates an annotated tag on a revision, an existing tag is an error.
+	CreateTag(name, rev, message string, tagger *CommitAuthor) (string, error)
+	// DeleteTag removes a tag.
+	DeleteTag(name string) error
+	// Tags lists the annotated tags whose name starts with prefix.
+	Tags(prefix string) ([]TagInfo, error)
+	// WriteArchive writes the files of a revision to w as a gzipped tarball.
+	// Paths for which skip returns true are left out.
+	WriteArchive(rev string, w io.Writer, skip func(relPath string) bool) error
+}
+
+var (
+	reposMutex sync.Mutex
+	repos      = make(map[string]Repo)
+)
+
+// returns the repository of a vault, opening it on first use
+func OpenRepo(vaultPath string) (Repo, error) {
+	reposMutex.Lock()
+	defer reposMutex.Unlock()
+	if repo, ok := repos[vaultPath]; ok {
+		return repo, nil
+	}
+	repository, err := git.PlainOpen(vaultPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open git repository: %w", err)
+	}
+	repo := &goGitRepo{path: vaultPath, repository: repository}
+	repos[vaultPath] = repo
+	return repo, nil
+}
+
+// goGitRepo implements Repo in-process with go-git.
+type goGitRepo struct {
+	path       string
+	repository *git.Repository
+	mutex      sync.RWMutex
+}
+
+func (r *goGitRepo) Head() (string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.head()
+}
+
+func (r *goGitRepo) head() (string, error) {
+	ref, err := r.repository.Head()
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get current hash: %w", err)
+	}
+	return ref.Hash().String(), nil
+}
+
+func (r *goGitRepo) Resolve(rev string) (string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commit, err := r.commit(rev)
+	if err != nil {
+		return "", err
+	}
+	return commit.Hash.String(), nil
+}
+
+func (r *goGitRepo) commit(rev string) (*object.Commit, error) {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return nil, fmt.Errorf("invalid revision %q", rev)
+	}
+	hash, err := r.repository.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("unknown revision %q", rev)
+	}
+	commit, err := r.repository.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("revision %q is not a commit", rev)
+	}
+	return commit, nil
+}
+
+func (r *goGitRepo) CommitAll(message string, author *CommitAuthor) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.commitAll(message, author, nil)
+}
+
+func (r *goGitRepo) CommitPaths(paths []string, message string, author *CommitAuthor) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	worktree, err := r.repository.Worktree()
+	if err != nil {
+		return "", err
+	}
+	patterns, err := r.ignorePatterns(worktree)
+	if err != nil {
+		return "", err
+	}
+	ignored := gitignore.NewMatcher(patterns)
+	var missing []string
+	for _, p := range paths {
+		relPath := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+		if relPath == "" || isReservedPath(relPath) || ignored.Match(strings.Split(relPath, "/"), false) {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(r.path, filepath.FromSlash(relPath)))
+		switch {
+		case os.IsNotExist(err):
+			missing = append(missing, relPath)
+		case err != nil:
+			return "", err
+		case info.Mode().IsRegular():
+			if _, err := worktree.Add(relPath); err != nil {
+				return "", fmt.Errorf("failed to stage %s: %w", relPath, err)
+			}
+		}
+	}
+	if err := r.unstage(missing); err != nil {
+		return "", err
+	}
+
+	if author == nil {
+		author = &defaultSignature
+	}
+	now := time.Now()
+	hash, err := worktree.Commit(message, &git.CommitOptions{
+		Author:    &object.Signature{Name: author.Name, Email: author.Email, When: now},
+		Committer: &object.Signature{Name: defaultSignature.Name, Email: defaultSignature.Email, When: now},
+	})
+	if errors.Is(err, git.ErrEmptyCommit) {
+		return r.head()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to commit: %w", err)
+	}
+	return hash.String(), nil
+}
+
+// drops deleted paths from the index, a path may be a whole directory that is gone
+func (r *goGitRepo) unstage(relPaths []string) error {
+	if len(relPaths) == 0 {
+		return nil
+	}
+	idx, err := r.repository.Storer.Index()
+	if err != nil {
+		return err
+	}
+	entries := idx.Entries[:0]
+	for _, entry := range idx.Entries {
+		gone := false
+		for _, relPath := range relPaths {
+			if entry.Name == relPath || strings.HasPrefix(entry.Name, relPath+"/") {
+				gone = true
+				break
+			}
+		}
+		if !gone {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == len(idx.Entries) {
+		return nil
+	}
+	idx.Entries = entries
+	return r.repository.Storer.SetIndex(idx)
+}
+
+func (r *goGitRepo) CommitMerge(message string, author *CommitAuthor, other string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	head, err := r.head()
+	if err != nil {
+		return "", err
+	}
+	otherCommit, err := r.commit(other)
+	if err != nil {
+		return "", err
+	}
+	return r.commitAll(message, author, []plumbing.Hash{plumbing.NewHash(head), otherCommit.Hash})
+}
+
+// stages everything and commits; with explicit parents the commit is made even if the tree is unchanged
+func (r *goGitRepo) commitAll(message string, author *CommitAuthor, parents []plumbing.Hash) (string, error) {
+	worktree, err := r.repository.Worktree()
+	if err != nil {
+		return "", err
+	}
+	if worktree.Excludes, err = r.ignorePatterns(worktree); err != nil {
+		return "", err
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return "", fmt.Errorf("failed to stage changes: %w", err)
+	}
+	if err := r.untrackReserved(); err != nil {
+		return "", err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return "", fmt.Errorf("failed to get worktree status: %w", err)
+	}
+	if status.IsClean() && parents == nil {
+		return r.head()
+	}
+	if author == nil {
+		author = &defaultSignature
+	}
+	now := time.Now()
+	hash, err := worktree.Commit(message, &git.CommitOptions{
+		Author:    &object.Signature{Name: author.Name, Email: author.Email, When: now},
+		Committer: &object.Signature{Name: defaultSignature.Name, Email: defaultSignature.Email, When: now},
+		Parents:   parents,
+		// merges are recorded even when the merged tree equals ours
+		AllowEmptyCommits: parents != nil,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to commit: %w", err)
+	}
+	return hash.String(), nil
+}
+
+// .gitignore patterns plus .git/info/exclude, where InitRepo excludes the trash and staging directories
+// gitignore.ReadPatterns would read info/exclude as well, but the worktree file system refuses paths
+// inside .git, so it is read directly
+func (r *goGitRepo) ignorePatterns(worktree *git.Worktree) ([]gitignore.Pattern, error) {
+	patterns, err := gitignore.ReadPatterns(worktree.Filesystem, nil)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(filepath.Join(r.path, ".git", "info", "exclude"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, gitignore.ParsePattern(line, nil))
+		}
+	}
+	return patterns, nil
+}
+
+// drops server directories (trash, staging) from the index, a vault may track them from before they were excluded
+func (r *goGitRepo) untrackReserved() error {
+	idx, err := r.repository.Storer.Index()
+	if err != nil {
+		return err
+	}
+	entries := idx.Entries[:0]
+	for _, entry := range idx.Entries {
+		if !isReservedPath(entry.Name) {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == len(idx.Entries) {
+		return nil
+	}
+	idx.Entries = entries
+	return r.repository.Storer.SetIndex(idx)
+}
+
+func (r *goGitRepo) Log(opts LogOptions) ([]CommitInfo, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	from := opts.From
+	if from == "" {
+		from = "HEAD"
+	}
+	start, err := r.commit(from)
+	if err != nil {
+		return nil, err
+	}
+	logOpts := &git.LogOptions{From: start.Hash}
+	if !opts.Until.IsZero() {
+		until := opts.Until
+		logOpts.Until = &until
+	}
+	iter, err := r.repository.Log(logOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var commits []CommitInfo
+	for {
+		commit, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, CommitInfo{
+			Hash:        commit.Hash.String(),
+			AuthorName:  commit.Author.Name,
+			AuthorEmail: commit.Author.Email,
+			When:        commit.Committer.When,
+			Message:     commit.Message,
+			Merge:       commit.NumParents() > 1,
+		})
+		if opts.Limit > 0 && len(commits) >= opts.Limit {
+			break
+		}
+	}
+	return commits, nil
+}
+
+func (r *goGitRepo) ListFiles(rev, dir string) ([]string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commit, err := r.commit(rev)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if tree, err = tree.Tree(dir); err != nil {
+			if errors.Is(err, object.ErrDirectoryNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	var files []string
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files = append(files, path.Join(dir, f.Name))
+		return nil
+	})
+	return files, err
+}
+
+func (r *goGitRepo) ReadFile(rev, relPath string) ([]byte, bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commit, err := r.commit(rev)
+	if err != nil {
+		return nil, false, err
+	}
+	file, err := commit.File(relPath)
+	if err != nil {
+		if errors.Is(err, object.ErrFileNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, false, err
+	}
+	return content, true, nil
+}
+
+// tree changes between two revisions, without rename detection
+func (r *goGitRepo) treeChanges(from, to string) (object.Changes, error) {
+	fromCommit, err := r.commit(from)
+	if err != nil {
+		return nil, err
+	}
+	toCommit, err := r.commit(to)
+	if err != nil {
+		return nil, err
+	}
+	fromTree, err := fromCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := toCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return object.DiffTree(fromTree, toTree)
+}
+
+func (r *goGitRepo) ChangedPaths(from, to string) ([]PathChange, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	changes, err := r.treeChanges(from, to)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]PathChange, 0, len(changes))
+	for _, change := range changes {
+		switch {
+		case change.From.Name == "":
+			paths = append(paths, PathChange{Path: change.To.Name, Action: ChangeAdded})
+		case change.To.Name == "":
+			paths = append(paths, PathChange{Path: change.From.Name, Action: ChangeDeleted})
+		default:
+			paths = append(paths, PathChange{Path: change.To.Name, Action: ChangeModified})
+		}
+	}
+	return paths, nil
+}
+
+func (r *goGitRepo) DiffFile(from, to, relPath string) (string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	changes, err := r.treeChanges(from, to)
+	if err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		if change.From.Name != relPath && change.To.Name != relPath {
+			continue
+		}
+		patch, err := change.Patch()
+		if err != nil {
+			return "", err
+		}
+		return patch.String(), nil
+	}
+	return "", nil // unchanged
+}
+
+func (r *goGitRepo) CheckoutFiles(rev string, skip func(relPath string) bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	head, err := r.head()
+	if err != nil {
+		return err
+	}
+	if head == "" {
+		return fmt.Errorf("repository has no commits")
+	}
+	target, err := r.commit(rev)
+	if err != nil {
+		return err
+	}
+	changes, err := r.treeChanges(head, target.Hash.String())
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		relPath := change.To.Name
+		if relPath == "" {
+			relPath = change.From.Name
+		}
+		if isReservedPath(relPath) || (skip != nil && skip(relPath)) {
+			continue
+		}
+		fullPath := filepath.Join(r.path, filepath.FromSlash(relPath))
+		if change.To.Name == "" {
+			noteServerRemove(relPath)
+			if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", relPath, err)
+			}
+			continue
+		}
+		file, err := target.File(relPath)
+		if err != nil {
+			return err
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return err
+		}
+		noteServerWrite(relPath, []byte(content))
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", relPath, err)
+		}
+	}
+	return nil
+}
+
+func (r *goGitRepo) Push(remote Remote, force bool) error {
+	auth, err := remote.auth()
+	if err != nil {
+		return err
+	}
+	// a separate handle keeps slow or hanging remotes from holding the repository lock,
+	// objects and refs on disk are only ever replaced atomically
+	repository, err := git.PlainOpen(r.path)
+	if err != nil {
+		return err
+	}
+	// in-memory remote, credentials never end up in .git/config
+	gitRemote := git.NewRemote(repository.Storer, &config.RemoteConfig{Name: remote.Name, URLs: []string{remote.URL}})
+	err = gitRemote.Push(&git.PushOptions{
+		RemoteName: remote.Name,
+		RefSpecs:   []config.RefSpec{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"},
+		Auth:       auth,
+		Force:      force,
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	return err
+}
+
+func (r *goGitRepo) Fetch(remote Remote, branch string) (string, error) {
+	auth, err := remote.auth()
+	if err != nil {
+		return "", err
+	}
+	// fetch through a separate handle so the network round trip happens without the lock
+	repository, err := git.PlainOpen(r.path)
+	if err != nil {
+		return "", err
+	}
+	trackingRef := plumbing.NewRemoteReferenceName(remote.Name, branch)
+	gitRemote := git.NewRemote(repository.Storer, &config.RemoteConfig{Name: remote.Name, URLs: []string{remote.URL}})
+	err = gitRemote.Fetch(&git.FetchOptions{
+		RemoteName: remote.Name,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(branch), trackingRef))},
+		Auth:       auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return "", err
+	}
+
+	// reopen so cached pack lists include what was just fetched
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reopened, err := git.PlainOpen(r.path)
+	if err != nil {
+		return "", err
+	}
+	r.repository = reopened
+	ref, err := r.repository.Reference(trackingRef, true)
+	if err != nil {
+		return "", fmt.Errorf("branch %s not found on %s: %w", branch, remote.RedactedURL(), err)
+	}
+	return ref.Hash().String(), nil
+}
+
+func (r *goGitRepo) RemoteBranches(remote Remote) (map[string]string, error) {
+	auth, err := remote.auth()
+	if err != nil {
+		return nil, err
+	}
+	// no lock is needed, listing only talks to the remote
+	gitRemote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: remote.Name, URLs: []string{remote.URL}})
+	refs, err := gitRemote.List(&git.ListOptions{Auth: auth})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	branches := make(map[string]string)
+	for _, ref := range refs {
+		if ref.Name().IsBranch() && ref.Type() == plumbing.HashReference {
+			branches[ref.Name().Short()] = ref.Hash().String()
+		}
+	}
+	return branches, nil
+}
+
+func (r *goGitRepo) MergeBase(a, b string) (string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commitA, err := r.commit(a)
+	if err != nil {
+		return "", err
+	}
+	commitB, err := r.commit(b)
+	if err != nil {
+		return "", err
+	}
+	bases, err := commitA.MergeBase(commitB)
+	if err != nil {
+		return "", err
+	}
+	if len(bases) == 0 {
+		return "", nil
+	}
+	return bases[0].Hash.String(), nil
+}
+
+func (r *goGitRepo) SetHead(hash string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	commit, err := r.commit(hash)
+	if err != nil {
+		return err
+	}
+	head, err := r.repository.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+	branch := head.Target()
+	if head.Type() != plumbing.SymbolicReference {
+		return fmt.Errorf("HEAD is detached")
+	}
+	return r.repository.Storer.SetReference(plumbing.NewHashReference(branch, commit.Hash))
+}
+
+// first-parent chain of HEAD, oldest first
+func (r *goGitRepo) firstParentChain() ([]*object.Commit, error) {
+	head, err := r.head()
+	if err != nil || head == "" {
+		return nil, err
+	}
+	commit, err := r.repository.CommitObject(plumbing.NewHash(head))
+	if err != nil {
+		return nil, err
+	}
+	var chain []*object.Commit
+	for {
+		chain = append(chain, commit)
+		if commit.NumParents() == 0 {
+			break
+		}
+		if commit, err = commit.Parent(0); err != nil {
+			return nil, err
+		}
+	}
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+func (r *goGitRepo) FirstParentLog() ([]CommitInfo, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	chain, err := r.firstParentChain()
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]CommitInfo, 0, len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		commits = append(commits, CommitInfo{
+			Hash:        chain[i].Hash.String(),
+			AuthorName:  chain[i].Author.Name,
+			AuthorEmail: chain[i].Author.Email,
+			When:        chain[i].Committer.When,
+			Message:     chain[i].Message,
+			Merge:       chain[i].NumParents() > 1,
+		})
+	}
+	return commits, nil
+}
+
+func (r *goGitRepo) TaggedCommits() (map[string][]string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	iter, err := r.repository.Tags()
+	if err != nil {
+		return nil, err
+	}
+	tagged := make(map[string][]string)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		target := ref.Hash()
+		if tag, err := r.repository.TagObject(target); err == nil {
+			target = tag.Target // annotated tag
+		}
+		tagged[target.String()] = append(tagged[target.String()], ref.Name().Short())
+		return nil
+	})
+	return tagged, err
+}
+
+func (r *goGitRepo) RewriteHistory(keep map[string]bool, ref string) (string, map[string]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	chain, err := r.firstParentChain()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(chain) == 0 {
+		return "", nil, fmt.Errorf("repository has no commits")
+	}
+	if !keep[chain[len(chain)-1].Hash.String()] {
+		return "", nil, fmt.Errorf("HEAD must be kept")
+	}
+	rewritten := make(map[string]string)
+	var parent plumbing.Hash
+	rewriting := false // commits before the first dropped one stay as they are
+	dropped := 0
+	for _, commit := range chain {
+		if !keep[commit.Hash.String()] {
+			rewriting = true
+			dropped++
+			continue
+		}
+		if !rewriting {
+			parent = commit.Hash
+			rewritten[commit.Hash.String()] = commit.Hash.String()
+			continue
+		}
+		message := commit.Message
+		if dropped > 0 {
+			message = WithTrailers(strings.TrimRight(message, "\n"), Trailer{Key: "Squashed-Commits", Value: strconv.Itoa(dropped)}) + "\n"
+		}
+		newCommit := &object.Commit{
+			Author:    commit.Author,
+			Committer: commit.Committer,
+			Message:   message,
+			TreeHash:  commit.TreeHash,
+		}
+		if !parent.IsZero() {
+			newCommit.ParentHashes = []plumbing.Hash{parent}
+		}
+		if commit.NumParents() > 1 {
+			newCommit.ParentHashes = append(newCommit.ParentHashes, commit.ParentHashes[1:]...)
+		}
+		obj := r.repository.Storer.NewEncodedObject()
+		if err := newCommit.Encode(obj); err != nil {
+			return "", nil, err
+		}
+		if parent, err = r.repository.Storer.SetEncodedObject(obj); err != nil {
+			return "", nil, fmt.Errorf("failed to write rewritten commit: %w", err)
+		}
+		rewritten[commit.Hash.String()] = parent.String()
+		dropped = 0
+	}
+	if err := r.repository.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(ref), parent)); err != nil {
+		return "", nil, err
+	}
+	return parent.String(), rewritten, nil
+}
+
+func (r *goGitRepo) ApplyRewrite(newHead string, rewritten map[string]string, ref string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	newCommit, err := r.repository.CommitObject(plumbing.NewHash(newHead))
+	if err != nil {
+		return 0, err
+	}
+	oldHead, err := r.head()
+	if err != nil {
+		return 0, err
+	}
+	oldCommit, err := r.repository.CommitObject(plumbing.NewHash(oldHead))
+	if err != nil {
+		return 0, err
+	}
+	if oldCommit.TreeHash != newCommit.TreeHash {
+		return 0, fmt.Errorf("rewritten history does not end in the current vault state")
+	}
+
+	head, err := r.repository.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return 0, err
+	}
+	if head.Type() != plumbing.SymbolicReference {
+		return 0, fmt.Errorf("HEAD is detached")
+	}
+	if err := r.repository.Storer.SetReference(plumbing.NewHashReference(head.Target(), newCommit.Hash)); err != nil {
+		return 0, err
+	}
+
+	moved, err := r.retargetTags(rewritten)
+	if err != nil {
+		return moved, err
+	}
+
+	refs, err := r.repository.References()
+	if err != nil {
+		return moved, err
+	}
+	var stale []plumbing.ReferenceName
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsRemote() {
+			stale = append(stale, ref.Name())
+		}
+		return nil
+	})
+	stale = append(stale, plumbing.ReferenceName(ref))
+	for _, name := range stale {
+		if err := r.repository.Storer.RemoveReference(name); err != nil {
+			return moved, err
+		}
+	}
+	// reflogs written by the git CLI would still point into the replaced history
+	return moved, os.RemoveAll(filepath.Join(r.path, ".git", "logs"))
+}
+
+// points tags at the rewritten version of their commit, annotated tags get a new tag object
+func (r *goGitRepo) retargetTags(rewritten map[string]string) (int, error) {
+	iter, err := r.repository.Tags()
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		tag, err := r.repository.TagObject(ref.Hash())
+		if err != nil {
+			newHash, ok := rewritten[ref.Hash().String()]
+			if !ok || newHash == ref.Hash().String() {
+				return nil
+			}
+			moved++
+			return r.repository.Storer.SetReference(plumbing.NewHashReference(ref.Name(), plumbing.NewHash(newHash)))
+		}
+		newHash, ok := rewritten[tag.Target.String()]
+		if !ok || newHash == tag.Target.String() {
+			return nil
+		}
+		newTag := &object.Tag{
+			Name:       tag.Name,
+			Tagger:     tag.Tagger,
+			Message:    tag.Message,
+			TargetType: plumbing.CommitObject,
+			Target:     plumbing.NewHash(newHash),
+		}
+		obj := r.repository.Storer.NewEncodedObject()
+		if err := newTag.Encode(obj); err != nil {
+			return err
+		}
+		tagHash, err := r.repository.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return err
+		}
+		moved++
+		return r.repository.Storer.SetReference(plumbing.NewHashReference(ref.Name(), tagHash))
+	})
+	return moved, err
+}
+
+// packs and loose objects younger than this survive a GC; fetches and pushes run without the repository lock,
+// so a fetched pack whose ref is not updated yet, or objects a push is sending, look unreachable for a moment
+const gcGracePeriod = time.Hour
+
+func (r *goGitRepo) GC() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cutoff := time.Now().Add(-gcGracePeriod)
+	if err := r.repository.RepackObjects(&git.RepackConfig{OnlyDeletePacksOlderThan: cutoff}); err != nil {
+		return fmt.Errorf("failed to repack: %w", err)
+	}
+	// reopen so the cached pack list matches what is on disk
+	reopened, err := git.PlainOpen(r.path)
+	if err != nil {
+		return err
+	}
+	r.repository = reopened
+	if err := r.repository.Prune(git.PruneOptions{OnlyObjectsOlderThan: cutoff, Handler: r.repository.DeleteObject}); err != nil {
+		return fmt.Errorf("failed to prune: %w", err)
+	}
+	return nil
+}
+
+func (r *goGitRepo) LargeBlobs(limit int) ([]LargeBlob, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	iter, err := r.repository.Log(&git.LogOptions{All: true})
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer iter.Close()
+	seenTrees := make(map[plumbing.Hash]bool)
+	blobs := make(map[plumbing.Hash]LargeBlob)
+	var walk func(treeHash plumbing.Hash, prefix string) error
+	walk = func(treeHash plumbing.Hash, prefix string) error {
+		if seenTrees[treeHash] {
+			return nil // unchanged subtrees are shared between commits
+		}
+		seenTrees[treeHash] = true
+		tree, err := r.repository.TreeObject(treeHash)
+		if err != nil {
+			return err
+		}
+		for _, entry := range tree.Entries {
+			entryPath := path.Join(prefix, entry.Name)
+			if entry.Mode == filemode.Dir {
+				if err := walk(entry.Hash, entryPath); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := blobs[entry.Hash]; ok || !entry.Mode.IsFile() {
+				continue
+			}
+			size, err := r.repository.Storer.EncodedObjectSize(entry.Hash)
+			if err != nil {
+				return err
+			}
+			blobs[entry.Hash] = LargeBlob{Hash: entry.Hash.String(), Path: entryPath, Size: size}
+		}
+		return nil
+	}
+	err = iter.ForEach(func(commit *object.Commit) error {
+		return walk(commit.TreeHash, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	largest := make([]LargeBlob, 0, len(blobs))
+	for _, blob := range blobs {
+		largest = append(largest, blob)
+	}
+	sort.Slice(largest, func(i, j int) bool {
+		if largest[i].Size != largest[j].Size {
+			return largest[i].Size > largest[j].Size
+		}
+		return largest[i].Hash < largest[j].Hash
+	})
+	if limit > 0 && len(largest) > limit {
+		largest = largest[:limit]
+	}
+	return largest, nil
+}
+
+func (r *goGitRepo) CreateTag(name, rev, message string, tagger *CommitAuthor) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	commit, err := r.commit(rev)
+	if err != nil {
+		return "", err
+	}
+	if tagger == nil {
+		tagger = &defaultSignature
+	}
+	_, err = r.repository.CreateTag(name, commit.Hash, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: tagger.Name, Email: tagger.Email, When: time.Now()},
+		Message: message,
+	})
+	if err != nil {
+		return "", err
+	}
+	return commit.Hash.String(), nil
+}
+
+func (r *goGitRepo) DeleteTag(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.repository.DeleteTag(name)
+}
+
+func (r *goGitRepo) Tags(prefix string) ([]TagInfo, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	iter, err := r.repository.Tags()
+	if err != nil {
+		return nil, err
+	}
+	var tags []TagInfo
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		tag, err := r.repository.TagObject(ref.Hash())
+		if err != nil {
+			return nil // lightweight tag
+		}
+		tags = append(tags, TagInfo{
+			Name:        name,
+			Hash:        tag.Target.String(),
+			TaggerName:  tag.Tagger.Name,
+			TaggerEmail: tag.Tagger.Email,
+			When:        tag.Tagger.When,
+			Message:     tag.Message,
+		})
+		return nil
+	})
+	return tags, err
+}
+
+func (r *goGitRepo) WriteArchive(rev string, w io.Writer, skip func(relPath string) bool) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commit, err := r.commit(rev)
+	if err != nil {
+		return err
+	}
+	files, err := commit.Files()
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err = files.ForEach(func(file *object.File) error {
+		if skip != nil && skip(file.Name) {
+			return nil
+		}
+		header := &tar.Header{
+			Name:     file.Name,
+			Mode:     0644,
+			Size:     file.Size,
+			ModTime:  commit.Committer.When,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		reader, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		_, err = io.Copy(tarWriter, reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
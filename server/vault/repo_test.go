@@ -0,0 +1,163 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// creates a vault with a git repository in a temporary directory
+func newTestVault(t *testing.T) (string, Repo) {
+	t.Helper()
+	vaultPath := t.TempDir()
+	if err := InitRepo(vaultPath); err != nil {
+		t.Fatalf("InitRepo: %v", err)
+	}
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		t.Fatalf("OpenRepo: %v", err)
+	}
+	return vaultPath, repo
+}
+
+// writes a vault file and commits everything
+func commitFile(t *testing.T, vaultPath string, repo Repo, relPath, content string) string {
+	t.Helper()
+	writeTestFile(t, vaultPath, relPath, content)
+	hash, err := repo.CommitAll("update "+relPath, nil)
+	if err != nil {
+		t.Fatalf("CommitAll: %v", err)
+	}
+	return hash
+}
+
+func writeTestFile(t *testing.T, dir, relPath, content string) {
+	t.Helper()
+	fullPath := filepath.Join(dir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushToBareMirror(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	barePath := t.TempDir()
+	bare, err := git.PlainInit(barePath, true)
+	if err != nil {
+		t.Fatalf("init bare mirror: %v", err)
+	}
+	remote := Remote{Name: "mirror", URL: barePath}
+	first := commitFile(t, vaultPath, repo, "a.md", "one")
+
+	steps := []struct {
+		name    string
+		change  func() string // returns the commit the mirror should end up at
+		force   bool
+		wantErr bool
+	}{
+		{name: "first push", change: func() string { return first }},
+		{name: "fast-forward", change: func() string { return commitFile(t, vaultPath, repo, "notes/b.md", "two") }},
+		{name: "up to date", change: func() string { head, _ := repo.Head(); return head }},
+		{
+			name: "diverged history is refused without force",
+			change: func() string {
+				mirrored, _ := repo.Head()
+				if err := repo.SetHead(first); err != nil {
+					t.Fatalf("SetHead: %v", err)
+				}
+				commitFile(t, vaultPath, repo, "c.md", "rewritten")
+				return mirrored
+			},
+			wantErr: true,
+		},
+		{name: "forced push replaces it", change: func() string { head, _ := repo.Head(); return head }, force: true},
+	}
+	for _, step := range steps {
+		want := step.change()
+		err := repo.Push(remote, step.force)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: Push() error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+		ref, err := bare.Reference("refs/heads/master", true)
+		if err != nil {
+			t.Fatalf("%s: mirror branch: %v", step.name, err)
+		}
+		if got := ref.Hash().String(); got != want {
+			t.Errorf("%s: mirror at %s, want %s", step.name, got, want)
+		}
+	}
+}
+
+func TestCommitsLeaveServerDirectoriesOut(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	writeTestFile(t, vaultPath, TrashDir+"/1/old.md", "deleted")
+	writeTestFile(t, vaultPath, StagingDir+"/sync-1/new/up.md", "upload")
+	head := commitFile(t, vaultPath, repo, "note.md", "kept")
+
+	files, err := repo.ListFiles(head, "")
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	if len(files) != 1 || files[0] != "note.md" {
+		t.Errorf("committed %v, want only note.md", files)
+	}
+	// nothing but the excluded directories changed, so there is nothing to commit
+	if again, err := repo.CommitAll("again", nil); err != nil || again != head {
+		t.Errorf("CommitAll() = %s, %v, want %s", again, err, head)
+	}
+}
+
+func TestCommitPaths(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	writeTestFile(t, vaultPath, "keep.md", "base")
+	writeTestFile(t, vaultPath, "dir/a.md", "a")
+	writeTestFile(t, vaultPath, "dir/sub/b.md", "b")
+	base, err := repo.CommitAll("base", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, vaultPath, "keep.md", "changed, waiting for its own commit")
+	writeTestFile(t, vaultPath, "new.md", "new")
+	if err := os.RemoveAll(filepath.Join(vaultPath, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		paths     []string
+		wantFiles []string
+	}{
+		{name: "nothing changed", paths: []string{"missing.md"}, wantFiles: []string{"dir/a.md", "dir/sub/b.md", "keep.md"}},
+		{name: "added file", paths: []string{"new.md"}, wantFiles: []string{"dir/a.md", "dir/sub/b.md", "keep.md", "new.md"}},
+		{name: "removed directory", paths: []string{"dir"}, wantFiles: []string{"keep.md", "new.md"}},
+	}
+	previous := base
+	for _, tt := range tests {
+		hash, err := repo.CommitPaths(tt.paths, tt.name, nil)
+		if err != nil {
+			t.Fatalf("%s: CommitPaths: %v", tt.name, err)
+		}
+		if tt.name == "nothing changed" && hash != previous {
+			t.Errorf("%s: made commit %s, want HEAD %s", tt.name, hash, previous)
+		}
+		files, err := repo.ListFiles(hash, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(files, tt.wantFiles) {
+			t.Errorf("%s: committed files %v, want %v", tt.name, files, tt.wantFiles)
+		}
+		previous = hash
+	}
+	// the change that was not listed stays uncommitted
+	content, _, err := repo.ReadFile("HEAD", "keep.md")
+	if err != nil || string(content) != "base" {
+		t.Errorf("keep.md at HEAD = %q (%v), want the base version", content, err)
+	}
+}
@@ -0,0 +1,139 @@
+package vault
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// rewriteStateFile remembers history rewrites across restarts; it lives in .git so it is never committed
+const rewriteStateFile = "yamanaka-rewrite.json"
+
+// rewriteState is what mirrors and upstream sync need to know about past history compactions.
+type rewriteState struct {
+	Generation         int            `json:"generation"`                    // bumped by every compaction that rewrote history
+	ReplacedCommits    map[string]int `json:"replaced,omitempty"`            // commits dropped or rewritten by compaction, with its generation
+	MirrorGenerations  map[string]int `json:"mirror_generations,omitempty"`  // generation last force pushed, per mirror remote
+	Mirrors            []string       `json:"mirrors,omitempty"`             // mirror remotes configured at the last compaction
+	HasUpstream        bool           `json:"has_upstream,omitempty"`        // an upstream branch was synced at the last compaction
+	UpstreamGeneration int            `json:"upstream_generation,omitempty"` // generation the upstream branch was last seen past
+	LegacyReplaced     []string       `json:"replaced_commits,omitempty"`    // replaced commits as stored by older versions
+}
+
+var rewriteStateMutex sync.Mutex
+
+// a missing or unreadable file is an empty state, the error is logged
+func loadRewriteState(vaultPath string) rewriteState {
+	st := rewriteState{}
+	data, err := os.ReadFile(filepath.Join(vaultPath, ".git", rewriteStateFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("could not read history rewrite state", "error", err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		slog.Error("could not parse history rewrite state", "error", err)
+	}
+	for _, hash := range st.LegacyReplaced {
+		if st.ReplacedCommits == nil {
+			st.ReplacedCommits = make(map[string]int)
+		}
+		st.ReplacedCommits[hash] = st.Generation
+	}
+	st.LegacyReplaced = nil
+	return st
+}
+
+// forgets replaced commits nothing can bring back any more: every mirror took over the history that
+// replaced them and the upstream branch, if there is one, has been seen past them
+func (st *rewriteState) prune() {
+	for hash, generation := range st.ReplacedCommits {
+		if st.HasUpstream && st.UpstreamGeneration < generation {
+			continue
+		}
+		if slices.ContainsFunc(st.Mirrors, func(name string) bool { return st.MirrorGenerations[name] < generation }) {
+			continue
+		}
+		delete(st.ReplacedCommits, hash)
+	}
+}
+
+// applies change to the stored state and writes it back atomically
+func updateRewriteState(vaultPath string, change func(*rewriteState)) error {
+	rewriteStateMutex.Lock()
+	defer rewriteStateMutex.Unlock()
+	st := loadRewriteState(vaultPath)
+	change(&st)
+	st.prune()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(vaultPath, ".git", rewriteStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// records a compaction before the branch is moved, so a crash never leaves mirrors unaware of it
+// the replaced commits are remembered until the given mirrors and the upstream took over the new history
+func recordRewrite(vaultPath string, chain []CommitInfo, rewritten map[string]string, mirrors []string, hasUpstream bool) error {
+	return updateRewriteState(vaultPath, func(st *rewriteState) {
+		st.Generation++
+		st.Mirrors = mirrors
+		st.HasUpstream = hasUpstream
+		if st.ReplacedCommits == nil {
+			st.ReplacedCommits = make(map[string]int)
+		}
+		for _, commit := range chain {
+			if _, ok := st.ReplacedCommits[commit.Hash]; rewritten[commit.Hash] != commit.Hash && !ok {
+				st.ReplacedCommits[commit.Hash] = st.Generation
+			}
+		}
+	})
+}
+
+// reports whether a commit was replaced by compaction
+func wasReplaced(vaultPath, hash string) bool {
+	rewriteStateMutex.Lock()
+	defer rewriteStateMutex.Unlock()
+	_, ok := loadRewriteState(vaultPath).ReplacedCommits[hash]
+	return ok
+}
+
+// records the head of the upstream branch and reports whether compaction replaced it
+func recordUpstreamHead(vaultPath, hash string) (bool, error) {
+	replaced := false
+	err := updateRewriteState(vaultPath, func(st *rewriteState) {
+		if _, replaced = st.ReplacedCommits[hash]; !replaced {
+			st.UpstreamGeneration = st.Generation
+		}
+	})
+	return replaced, err
+}
+
+// the generation a mirror remote has to be force pushed to, zero when a regular push will do
+func pendingForcePush(vaultPath, remoteName string) int {
+	rewriteStateMutex.Lock()
+	defer rewriteStateMutex.Unlock()
+	st := loadRewriteState(vaultPath)
+	if st.MirrorGenerations[remoteName] >= st.Generation {
+		return 0
+	}
+	return st.Generation
+}
+
+// records that a mirror remote took over the history of a generation
+func recordForcePush(vaultPath, remoteName string, generation int) error {
+	return updateRewriteState(vaultPath, func(st *rewriteState) {
+		if st.MirrorGenerations == nil {
+			st.MirrorGenerations = make(map[string]int)
+		}
+		st.MirrorGenerations[remoteName] = max(st.MirrorGenerations[remoteName], generation)
+	})
+}
@@ -0,0 +1,62 @@
+package vault
+
+import "testing"
+
+func TestReplacedCommitsArePruned(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	oldHead := commitFile(t, vaultPath, repo, "a.md", "one")
+	commitFile(t, vaultPath, repo, "a.md", "two")
+	chain, err := repo.FirstParentLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := map[string]string{chain[0].Hash: "new head", oldHead: ""}
+	if err := recordRewrite(vaultPath, chain, rewritten, []string{"mirror-1", "mirror-2"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name         string
+		apply        func() error
+		wantReplaced bool
+	}{
+		{"after compaction", func() error { return nil }, true},
+		{"one mirror force pushed", func() error { return recordForcePush(vaultPath, "mirror-1", 1) }, true},
+		{"both mirrors force pushed", func() error { return recordForcePush(vaultPath, "mirror-2", 1) }, true},
+		{"upstream still at a replaced commit", func() error {
+			replaced, err := recordUpstreamHead(vaultPath, oldHead)
+			if !replaced {
+				t.Errorf("recordUpstreamHead() did not report the replaced commit")
+			}
+			return err
+		}, true},
+		{"upstream moved past the rewrite", func() error {
+			_, err := recordUpstreamHead(vaultPath, "new head")
+			return err
+		}, false},
+	}
+	for _, step := range steps {
+		if err := step.apply(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := wasReplaced(vaultPath, oldHead); got != step.wantReplaced {
+			t.Errorf("%s: wasReplaced() = %v, want %v", step.name, got, step.wantReplaced)
+		}
+	}
+}
+
+func TestReplacedCommitsWithoutRemotes(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	oldHead := commitFile(t, vaultPath, repo, "a.md", "one")
+	commitFile(t, vaultPath, repo, "a.md", "two")
+	chain, err := repo.FirstParentLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recordRewrite(vaultPath, chain, map[string]string{chain[0].Hash: "new head"}, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if wasReplaced(vaultPath, oldHead) {
+		t.Errorf("a replaced commit is remembered although no remote could bring it back")
+	}
+}
@@ -0,0 +1,151 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+// snapshots are annotated tags in their own namespace so they never collide with tags pushed from elsewhere
+const snapshotTagPrefix = "snapshot/"
+
+var (
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+)
+
+// Snapshot is a named, permanent point in the vault history.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// commits any pending changes and tags the current state as a snapshot
+// the pending changes are committed by the server, tagger only creates the snapshot
+func CreateSnapshot(vaultPath, name, note string, tagger *CommitAuthor) (Snapshot, error) {
+	if !snapshotNamePattern.MatchString(name) || strings.HasSuffix(name, ".lock") || strings.Contains(name, "..") {
+		return Snapshot{}, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	head, err := repo.CommitAll(fmt.Sprintf("Commit before snapshot %s", name), nil)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if head == "" {
+		return Snapshot{}, fmt.Errorf("vault has no commits yet")
+	}
+	return tagSnapshot(repo, name, head, note, tagger)
+}
+
+// tags a commit as a snapshot, the caller holds state.FileSystemMutex
+func tagSnapshot(repo Repo, name, hash, note string, tagger *CommitAuthor) (Snapshot, error) {
+	// the first line names the snapshot, the note follows as the tag body
+	message := "Snapshot " + name
+	if note = strings.TrimSpace(note); note != "" {
+		message += "\n\n" + note
+	}
+	if _, err := repo.CreateTag(snapshotTagPrefix+name, hash, message, tagger); err != nil {
+		if errors.Is(err, git.ErrTagExists) {
+			return Snapshot{}, ErrSnapshotExists
+		}
+		return Snapshot{}, err
+	}
+	return findSnapshot(repo, name)
+}
+
+// lists every snapshot, newest first
+func ListSnapshots(vaultPath string) ([]Snapshot, error) {
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := repo.Tags(snapshotTagPrefix)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Snapshot, 0, len(tags))
+	for _, tag := range tags {
+		snapshots = append(snapshots, snapshotFromTag(tag))
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	return snapshots, nil
+}
+
+// removes a snapshot, the commits stay in history until compaction drops them
+func DeleteSnapshot(vaultPath, name string) error {
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return err
+	}
+	if _, err := findSnapshot(repo, name); err != nil {
+		return err
+	}
+	return repo.DeleteTag(snapshotTagPrefix + name)
+}
+
+// returns the commit a snapshot points to
+func ResolveSnapshot(vaultPath, name string) (string, error) {
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return "", err
+	}
+	snapshot, err := findSnapshot(repo, name)
+	if err != nil {
+		return "", err
+	}
+	return snapshot.Hash, nil
+}
+
+// writes the files of a snapshot to w as a gzipped tarball (same layout as the initial sync upload)
+func WriteSnapshotArchive(vaultPath, name string, w io.Writer) error {
+	hash, err := ResolveSnapshot(vaultPath, name)
+	if err != nil {
+		return err
+	}
+	repo, err := OpenRepo(vaultPath)
+	if err != nil {
+		return err
+	}
+	return repo.WriteArchive(hash, w, isInternalPath)
+}
+
+func findSnapshot(repo Repo, name string) (Snapshot, error) {
+	tags, err := repo.Tags(snapshotTagPrefix)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, tag := range tags {
+		if tag.Name == snapshotTagPrefix+name {
+			return snapshotFromTag(tag), nil
+		}
+	}
+	return Snapshot{}, ErrSnapshotNotFound
+}
+
+func snapshotFromTag(tag TagInfo) Snapshot {
+	_, note, _ := strings.Cut(tag.Message, "\n\n")
+	return Snapshot{
+		Name:      strings.TrimPrefix(tag.Name, snapshotTagPrefix),
+		Hash:      tag.Hash,
+		CreatedAt: tag.When,
+		CreatedBy: tag.TaggerName,
+		Note:      strings.TrimSpace(note),
+	}
+}
@@ -0,0 +1,116 @@
+package vault
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	commitFile(t, vaultPath, repo, "a.md", "one")
+	writeTestFile(t, vaultPath, "b.md", "not committed yet")
+	laptop := DeviceAuthor("laptop", "Laptop")
+
+	first, err := CreateSnapshot(vaultPath, "before-import", "  the vault before the import\n", laptop)
+	if err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	if first.CreatedBy != "Laptop" || first.Note != "the vault before the import" {
+		t.Errorf("snapshot = %+v, want the laptop as tagger and the trimmed note", first)
+	}
+	commits, err := repo.FirstParentLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits[0].Hash != first.Hash || commits[0].AuthorName != defaultSignature.Name {
+		t.Errorf("pre-snapshot commit %s by %s, want %s by the server", commits[0].Hash, commits[0].AuthorName, first.Hash)
+	}
+
+	commitFile(t, vaultPath, repo, "a.md", "two")
+	second, err := CreateSnapshot(vaultPath, "after-import", "", nil)
+	if err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	tests := []struct {
+		name    string
+		wantErr error
+	}{
+		{"before-import", ErrSnapshotExists},
+		{"../escape", nil},
+		{"name.lock", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		_, err := CreateSnapshot(vaultPath, tt.name, "", nil)
+		if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+			t.Errorf("CreateSnapshot(%q) error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	snapshots, err := ListSnapshots(vaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	slices.Sort(names) // both were created within the same second, tag times have no finer resolution
+	if !slices.Equal(names, []string{"after-import", "before-import"}) {
+		t.Errorf("ListSnapshots() = %v, want both snapshots", names)
+	}
+	if hash, err := ResolveSnapshot(vaultPath, "after-import"); err != nil || hash != second.Hash {
+		t.Errorf("ResolveSnapshot() = %s, %v, want %s", hash, err, second.Hash)
+	}
+
+	var archive bytes.Buffer
+	if err := WriteSnapshotArchive(vaultPath, "before-import", &archive); err != nil {
+		t.Fatalf("WriteSnapshotArchive: %v", err)
+	}
+	if files := readTestArchive(t, &archive); len(files) != 2 || files["a.md"] != "one" || files["b.md"] != "not committed yet" {
+		t.Errorf("archive = %v, want the files at the snapshot", files)
+	}
+
+	if err := DeleteSnapshot(vaultPath, "before-import"); err != nil {
+		t.Fatalf("DeleteSnapshot: %v", err)
+	}
+	if err := DeleteSnapshot(vaultPath, "before-import"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("second DeleteSnapshot() = %v, want ErrSnapshotNotFound", err)
+	}
+	if _, err := ResolveSnapshot(vaultPath, "before-import"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("ResolveSnapshot() of a deleted snapshot = %v, want ErrSnapshotNotFound", err)
+	}
+}
+
+// returns the regular files of a gzipped tarball by path
+func readTestArchive(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	tarReader := tar.NewReader(gz)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(data)
+	}
+}
@@ -0,0 +1,210 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+// TrashDir holds deleted files inside the vault; it is git-ignored and never sent to clients.
+const TrashDir = ".yamanaka_trash"
+
+const (
+	trashMetaFile    = "meta.json"
+	trashContentFile = "content"
+)
+
+// ErrRestoreConflict is returned when a file already exists at the path a trash entry would be restored to.
+var ErrRestoreConflict = errors.New("a file already exists at the original path")
+
+// TrashEntry describes one deleted file kept in the trash.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	DeviceID  string    `json:"device_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Size      int64     `json:"size"`
+}
+
+// moves a vault file into the trash, recording who deleted it and when
+// caller must hold state.FileSystemMutex
+func moveToTrash(vaultPath, relPath, deviceID string) error {
+	fullPath := filepath.Join(vaultPath, relPath)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", relPath)
+	}
+	entry := TrashEntry{
+		ID:        strconv.FormatInt(time.Now().UnixNano(), 10),
+		Path:      filepath.ToSlash(relPath),
+		DeviceID:  deviceID,
+		DeletedAt: time.Now().UTC(),
+		Size:      info.Size(),
+	}
+	entryDir := filepath.Join(vaultPath, TrashDir, entry.ID)
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return err
+	}
+	meta, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(entryDir, trashMetaFile), meta, 0644); err != nil {
+		os.RemoveAll(entryDir)
+		return err
+	}
+	noteServerRemove(relPath)
+	if err := os.Rename(fullPath, filepath.Join(entryDir, trashContentFile)); err != nil {
+		os.RemoveAll(entryDir)
+		return err
+	}
+	return nil
+}
+
+// returns all trash entries, most recently deleted first
+func ListTrash(vaultPath string) ([]TrashEntry, error) {
+	state.FileSystemMutex.RLock()
+	defer state.FileSystemMutex.RUnlock()
+	dirEntries, err := os.ReadDir(filepath.Join(vaultPath, TrashDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []TrashEntry{}, nil
+		}
+		return nil, err
+	}
+	entries := make([]TrashEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		entry, err := readTrashEntry(vaultPath, dirEntry.Name())
+		if err != nil {
+			continue // half-written entry, left for purge
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+func readTrashEntry(vaultPath, id string) (TrashEntry, error) {
+	var entry TrashEntry
+	if id == "" || id != filepath.Base(id) || id == "." || id == ".." {
+		return entry, fmt.Errorf("invalid trash id %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(vaultPath, TrashDir, id, trashMetaFile))
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// moves a trash entry back to its original path and returns the entry and restored content
+func RestoreFromTrash(vaultPath, id string) (TrashEntry, []byte, error) {
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	entry, err := readTrashEntry(vaultPath, id)
+	if err != nil {
+		return entry, nil, err
+	}
+	relPath, err := CleanRelPath(entry.Path)
+	if err != nil {
+		return entry, nil, err
+	}
+	fullPath := filepath.Join(vaultPath, relPath)
+	if _, err := os.Stat(fullPath); err == nil {
+		return entry, nil, ErrRestoreConflict
+	}
+	entryDir := filepath.Join(vaultPath, TrashDir, id)
+	content, err := os.ReadFile(filepath.Join(entryDir, trashContentFile))
+	if err != nil {
+		return entry, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return entry, nil, err
+	}
+	noteServerWrite(relPath, content)
+	if err := os.Rename(filepath.Join(entryDir, trashContentFile), fullPath); err != nil {
+		return entry, nil, err
+	}
+	return entry, content, os.RemoveAll(entryDir)
+}
+
+// permanently removes one trash entry
+func PurgeTrash(vaultPath, id string) error {
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	if _, err := readTrashEntry(vaultPath, id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(vaultPath, TrashDir, id))
+}
+
+// permanently removes every trash entry
+func PurgeAllTrash(vaultPath string) (int, error) {
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	dirEntries, err := os.ReadDir(filepath.Join(vaultPath, TrashDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	for _, dirEntry := range dirEntries {
+		if err := os.RemoveAll(filepath.Join(vaultPath, TrashDir, dirEntry.Name())); err != nil {
+			return 0, err
+		}
+	}
+	return len(dirEntries), nil
+}
+
+// removes trash entries deleted longer than retention ago
+func PurgeExpiredTrash(vaultPath string, retention time.Duration) (int, error) {
+	state.FileSystemMutex.Lock()
+	defer state.FileSystemMutex.Unlock()
+	dirEntries, err := os.ReadDir(filepath.Join(vaultPath, TrashDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	cutoff := time.Now().Add(-retention)
+	purged := 0
+	for _, dirEntry := range dirEntries {
+		entry, err := readTrashEntry(vaultPath, dirEntry.Name())
+		// entries without readable metadata are judged by their directory time
+		deletedAt := entry.DeletedAt
+		if err != nil {
+			info, statErr := dirEntry.Info()
+			if statErr != nil {
+				continue
+			}
+			deletedAt = info.ModTime()
+		}
+		if deletedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(vaultPath, TrashDir, dirEntry.Name())); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	vaultPath := t.TempDir()
+	writeTestFile(t, vaultPath, "notes/a.md", "a")
+	writeTestFile(t, vaultPath, "b.md", "b")
+	for _, relPath := range []string{"notes/a.md", "b.md"} {
+		if err := DeleteFile(vaultPath, relPath, "laptop"); err != nil {
+			t.Fatalf("DeleteFile(%s): %v", relPath, err)
+		}
+		if _, err := os.Stat(filepath.Join(vaultPath, relPath)); !os.IsNotExist(err) {
+			t.Errorf("%s is still in the vault: %v", relPath, err)
+		}
+	}
+	if err := DeleteFile(vaultPath, "notes", "laptop"); err == nil {
+		t.Errorf("DeleteFile(notes) trashed a directory")
+	}
+
+	entries, err := ListTrash(vaultPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Path != "b.md" || entries[1].Path != "notes/a.md" || entries[0].DeviceID != "laptop" {
+		t.Fatalf("ListTrash() = %+v, want b.md then notes/a.md deleted by laptop", entries)
+	}
+
+	// a file at the original path is never overwritten
+	writeTestFile(t, vaultPath, "notes/a.md", "new a")
+	if _, _, err := RestoreFromTrash(vaultPath, entries[1].ID); !errors.Is(err, ErrRestoreConflict) {
+		t.Errorf("RestoreFromTrash() over an existing file = %v, want ErrRestoreConflict", err)
+	}
+	entry, content, err := RestoreFromTrash(vaultPath, entries[0].ID)
+	if err != nil || entry.Path != "b.md" || string(content) != "b" {
+		t.Fatalf("RestoreFromTrash() = %+v, %q, %v, want b.md restored", entry, content, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(vaultPath, "b.md")); err != nil || string(data) != "b" {
+		t.Errorf("b.md = %q (%v) after the restore", data, err)
+	}
+
+	for _, id := range []string{"", ".", "..", "../notes", entries[0].ID} {
+		if err := PurgeTrash(vaultPath, id); err == nil {
+			t.Errorf("PurgeTrash(%q) succeeded, want an error", id)
+		}
+	}
+	if err := PurgeTrash(vaultPath, entries[1].ID); err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	if entries, _ := ListTrash(vaultPath); len(entries) != 0 {
+		t.Errorf("trash after purge = %+v, want empty", entries)
+	}
+	if data, err := os.ReadFile(filepath.Join(vaultPath, "notes", "a.md")); err != nil || string(data) != "new a" {
+		t.Errorf("purging touched the vault: notes/a.md = %q (%v)", data, err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	vaultPath := t.TempDir()
+	for _, relPath := range []string{"old.md", "recent.md"} {
+		writeTestFile(t, vaultPath, relPath, relPath)
+		if err := DeleteFile(vaultPath, relPath, "laptop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ListTrash(vaultPath)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ListTrash() = %+v, %v", entries, err)
+	}
+	// backdate old.md, and leave an entry without metadata that is judged by its directory time
+	for _, entry := range entries {
+		if entry.Path == "old.md" {
+			entry.DeletedAt = time.Now().Add(-48 * time.Hour)
+			writeTestFile(t, filepath.Join(vaultPath, TrashDir, entry.ID), trashMetaFile, `{"id": "`+entry.ID+`", "path": "old.md", "deleted_at": "`+entry.DeletedAt.Format(time.RFC3339)+`"}`)
+		}
+	}
+	broken := filepath.Join(vaultPath, TrashDir, "broken")
+	if err := os.MkdirAll(broken, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-72 * time.Hour)
+	if err := os.Chtimes(broken, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := PurgeExpiredTrash(vaultPath, 24*time.Hour)
+	if err != nil || purged != 2 {
+		t.Fatalf("PurgeExpiredTrash() = %d, %v, want 2 purged", purged, err)
+	}
+	entries, _ = ListTrash(vaultPath)
+	if len(entries) != 1 || entries[0].Path != "recent.md" {
+		t.Fatalf("trash after expiry = %+v, want only recent.md", entries)
+	}
+
+	purged, err = PurgeAllTrash(vaultPath)
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeAllTrash() = %d, %v, want 1 purged", purged, err)
+	}
+	if purged, err := PurgeAllTrash(t.TempDir()); err != nil || purged != 0 {
+		t.Errorf("PurgeAllTrash() without a trash = %d, %v", purged, err)
+	}
+}
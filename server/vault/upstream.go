@@ -0,0 +1,220 @@
+package vault
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+// IngestResult describes what an upstream sync changed in the vault.
+type IngestResult struct {
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Mode      string       `json:"mode"` // "up-to-date", "fast-forward" or "merge"
+	Changes   []PathChange `json:"changes"`
+	Conflicts []string     `json:"conflicts,omitempty"` // upstream versions saved next to the server's
+}
+
+// Upstream pulls commits made outside the server (e.g. plain git on a laptop pushing to the mirror)
+// from a remote branch into the vault.
+type Upstream struct {
+	vaultPath string
+	remote    Remote
+	branch    string
+	interval  time.Duration
+	committer *Committer // may be nil
+	onIngest  func(IngestResult)
+}
+
+// creates an upstream poller; onIngest is called for every sync that changed the vault
+// pushes still queued in committer are committed before a sync, so they keep their device as author
+func NewUpstream(vaultPath string, remote Remote, branch string, interval time.Duration, committer *Committer, onIngest func(IngestResult)) *Upstream {
+	if remote.Name == "" {
+		remote.Name = "upstream"
+	}
+	return &Upstream{vaultPath: vaultPath, remote: remote, branch: branch, interval: interval, committer: committer, onIngest: onIngest}
+}
+
+// starts polling the remote in the background
+func (u *Upstream) Start() {
+	slog.Info("upstream-goroutine: started", "url", u.remote.RedactedURL(), "branch", u.branch, "interval", u.interval)
+	ticker := time.NewTicker(u.interval)
+	go func() {
+		for range ticker.C {
+			if _, err := u.Sync(); err != nil {
+				slog.Error("upstream-goroutine: sync failed", "error", err)
+			}
+		}
+	}()
+}
+
+// fetches the remote branch and fast-forwards or merges it into the vault
+func (u *Upstream) Sync() (IngestResult, error) {
+	repo, err := OpenRepo(u.vaultPath)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	upstreamHash, err := repo.Fetch(u.remote, u.branch)
+	if err != nil {
+		return IngestResult{}, fmt.Errorf("fetch failed: %w", err)
+	}
+
+	u.committer.Flush()
+	state.FileSystemMutex.Lock()
+	result, err := u.integrate(repo, upstreamHash)
+	state.FileSystemMutex.Unlock()
+	if err != nil {
+		return result, err
+	}
+	if result.Mode != "up-to-date" {
+		slog.Info("upstream-goroutine: ingested", "mode", result.Mode, "hash", result.To, "changes", len(result.Changes), "conflicts", len(result.Conflicts))
+		if u.onIngest != nil {
+			u.onIngest(result)
+		}
+	}
+	return result, nil
+}
+
+// caller must hold state.FileSystemMutex
+func (u *Upstream) integrate(repo Repo, upstreamHash string) (IngestResult, error) {
+	// local edits not yet committed must be part of the comparison
+	head, err := repo.CommitAll("Commit before upstream sync", nil)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	result := IngestResult{From: head, To: head, Mode: "up-to-date", Changes: []PathChange{}}
+	if head == "" {
+		return result, fmt.Errorf("vault has no commits yet")
+	}
+	replaced, err := recordUpstreamHead(u.vaultPath, upstreamHash)
+	if err != nil {
+		return result, err
+	}
+	if head == upstreamHash || replaced {
+		return result, nil // a replaced upstream gets the compacted history from the forced mirror push
+	}
+	base, err := repo.MergeBase(head, upstreamHash)
+	if err != nil {
+		return result, err
+	}
+	if base == upstreamHash {
+		return result, nil // upstream is behind, the mirror push will bring it up to date
+	}
+	if base == "" {
+		return result, fmt.Errorf("upstream branch shares no history with the vault")
+	}
+
+	theirs, err := repo.ChangedPaths(base, upstreamHash)
+	if err != nil {
+		return result, err
+	}
+	message := fmt.Sprintf("Merge upstream %s/%s", u.remote.Name, u.branch)
+
+	if base == head {
+		result.Mode = "fast-forward"
+		if err := repo.CheckoutFiles(upstreamHash, isInternalPath); err != nil {
+			return result, err
+		}
+		if err := repo.SetHead(upstreamHash); err != nil {
+			return result, err
+		}
+		// server state files were left alone, record them if they differ from upstream
+		if result.To, err = repo.CommitAll("Keep server state after upstream fast-forward", nil); err != nil {
+			return result, err
+		}
+		result.Changes = filterContentChanges(theirs)
+		return result, nil
+	}
+
+	result.Mode = "merge"
+	ours, err := repo.ChangedPaths(base, head)
+	if err != nil {
+		return result, err
+	}
+	changedByUs := make(map[string]bool, len(ours))
+	for _, change := range ours {
+		changedByUs[change.Path] = true
+	}
+	for _, change := range filterContentChanges(theirs) {
+		if !changedByUs[change.Path] {
+			if err := applyChange(u.vaultPath, repo, upstreamHash, change); err != nil {
+				return result, err
+			}
+			result.Changes = append(result.Changes, change)
+			continue
+		}
+		// changed on both sides: the server version wins, a differing upstream version is kept as a copy
+		ourContent, ourExists, err := repo.ReadFile(head, change.Path)
+		if err != nil {
+			return result, err
+		}
+		theirContent, theirExists, err := repo.ReadFile(upstreamHash, change.Path)
+		if err != nil {
+			return result, err
+		}
+		if !theirExists || (ourExists && string(ourContent) == string(theirContent)) {
+			continue
+		}
+		conflictPath := conflictCopyPath(change.Path, "upstream conflict "+upstreamHash[:7])
+		if err := writeVaultFile(u.vaultPath, conflictPath, theirContent); err != nil {
+			return result, err
+		}
+		result.Conflicts = append(result.Conflicts, change.Path)
+		result.Changes = append(result.Changes, PathChange{Path: conflictPath, Action: ChangeAdded})
+	}
+	if result.To, err = repo.CommitMerge(message, nil, upstreamHash); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// drops server state paths from a change list
+func filterContentChanges(changes []PathChange) []PathChange {
+	filtered := make([]PathChange, 0, len(changes))
+	for _, change := range changes {
+		if !isInternalPath(change.Path) {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
+// applies one upstream change to the worktree
+func applyChange(vaultPath string, repo Repo, rev string, change PathChange) error {
+	if change.Action == ChangeDeleted {
+		noteServerRemove(change.Path)
+		err := os.Remove(filepath.Join(vaultPath, filepath.FromSlash(change.Path)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, _, err := repo.ReadFile(rev, change.Path)
+	if err != nil {
+		return err
+	}
+	return writeVaultFile(vaultPath, change.Path, content)
+}
+
+// writes a file without taking state.FileSystemMutex
+func writeVaultFile(vaultPath, relPath string, content []byte) error {
+	fullPath := filepath.Join(vaultPath, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	noteServerWrite(relPath, content)
+	return os.WriteFile(fullPath, content, 0644)
+}
+
+// "notes/a.md" -> "notes/a (upstream conflict 1a2b3c4).md"
+func conflictCopyPath(relPath, label string) string {
+	label = strings.NewReplacer("/", "-", "\\", "-").Replace(label)
+	ext := path.Ext(relPath)
+	return fmt.Sprintf("%s (%s)%s", strings.TrimSuffix(relPath, ext), label, ext)
+}
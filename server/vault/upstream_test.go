@@ -0,0 +1,139 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// a bare remote that holds the vault history, plus a plain git checkout of it, as on a laptop
+func newTestUpstream(t *testing.T, vaultPath string, repo Repo) (Remote, string) {
+	t.Helper()
+	barePath := t.TempDir()
+	if _, err := git.PlainInit(barePath, true); err != nil {
+		t.Fatal(err)
+	}
+	remote := Remote{Name: "upstream", URL: barePath}
+	if err := repo.Push(remote, false); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	checkout := t.TempDir()
+	if _, err := git.PlainClone(checkout, false, &git.CloneOptions{URL: barePath}); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	return remote, checkout
+}
+
+// commits a file in a plain checkout and pushes it to its origin
+func laptopCommit(t *testing.T, checkout, relPath, content string) string {
+	t.Helper()
+	writeTestFile(t, checkout, relPath, content)
+	repository, err := git.PlainOpen(checkout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(relPath); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := worktree.Commit("laptop edit", &git.CommitOptions{Author: &object.Signature{Name: "me", Email: "me@laptop", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Push(&git.PushOptions{}); err != nil {
+		t.Fatalf("laptop push: %v", err)
+	}
+	return hash.String()
+}
+
+func TestUpstreamSync(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	writeTestFile(t, vaultPath, "both.md", "base")
+	commitFile(t, vaultPath, repo, "a.md", "base")
+	remote, checkout := newTestUpstream(t, vaultPath, repo)
+
+	var ingested []IngestResult
+	upstream := NewUpstream(vaultPath, remote, "master", time.Hour, nil, func(result IngestResult) {
+		ingested = append(ingested, result)
+	})
+
+	// only upstream changed: fast-forward
+	laptopHash := laptopCommit(t, checkout, "a.md", "from the laptop")
+	result, err := upstream.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if result.Mode != "fast-forward" || result.To != laptopHash || len(ingested) != 1 {
+		t.Errorf("first sync = %+v, want a fast-forward to %s", result, laptopHash)
+	}
+	if data, _ := os.ReadFile(filepath.Join(vaultPath, "a.md")); string(data) != "from the laptop" {
+		t.Errorf("a.md = %q after the fast-forward", data)
+	}
+
+	// both sides changed: the server version wins, the upstream version is kept as a copy
+	laptopCommit(t, checkout, "both.md", "laptop version")
+	laptopHash = laptopCommit(t, checkout, "new.md", "new on the laptop")
+	commitFile(t, vaultPath, repo, "both.md", "server version")
+	result, err = upstream.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	conflictCopy := "both (upstream conflict " + laptopHash[:7] + ").md"
+	if result.Mode != "merge" || !slices.Equal(result.Conflicts, []string{"both.md"}) {
+		t.Fatalf("second sync = %+v, want a merge with a conflict on both.md", result)
+	}
+	for relPath, want := range map[string]string{"both.md": "server version", conflictCopy: "laptop version", "new.md": "new on the laptop"} {
+		if data, err := os.ReadFile(filepath.Join(vaultPath, filepath.FromSlash(relPath))); err != nil || string(data) != want {
+			t.Errorf("%s = %q (%v), want %q", relPath, data, err, want)
+		}
+	}
+	if base, err := repo.MergeBase(laptopHash, result.To); err != nil || base != laptopHash {
+		t.Errorf("the merge commit does not contain the upstream commit: base %s, %v", base, err)
+	}
+
+	// nothing new upstream
+	if result, err := upstream.Sync(); err != nil || result.Mode != "up-to-date" || len(ingested) != 2 {
+		t.Errorf("third sync = %+v, %v, want up-to-date", result, err)
+	}
+}
+
+func TestUpstreamSyncCommitsQueuedPushesFirst(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	commitFile(t, vaultPath, repo, "a.md", "base")
+	remote, checkout := newTestUpstream(t, vaultPath, repo)
+	laptopCommit(t, checkout, "laptop.md", "from the laptop")
+
+	committer := NewCommitter(vaultPath, time.Hour, time.Hour, nil)
+	writeTestFile(t, vaultPath, "pushed.md", "from the phone")
+	committer.Enqueue(phonePush("pushed.md"))
+	if _, err := NewUpstream(vaultPath, remote, "master", time.Hour, committer, nil).Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	commits, err := repo.Log(LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, commit := range commits {
+		files, err := repo.ChangedPaths(commit.Hash+"~1", commit.Hash)
+		if err != nil {
+			continue // the root commit
+		}
+		for _, change := range files {
+			if change.Path == "pushed.md" && commit.AuthorName != "Phone" {
+				t.Errorf("pushed.md was committed by %s in %q, want the phone", commit.AuthorName, commit.Message)
+			}
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(vaultPath, "laptop.md")); err != nil || string(data) != "from the laptop" {
+		t.Errorf("laptop.md = %q (%v), want the upstream version", data, err)
+	}
+}
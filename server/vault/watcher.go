@@ -0,0 +1,276 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/tanq16/yamanaka/server/state"
+)
+
+// how long the server's own writes are remembered so the watcher can tell them from external edits
+const serverWriteMemory = 2 * time.Minute
+
+type serverWrite struct {
+	exists bool
+	hash   string
+	at     time.Time
+}
+
+var (
+	serverWritesMutex sync.Mutex
+	serverWrites      = make(map[string]serverWrite)
+)
+
+// records that the server itself wrote a vault file
+func noteServerWrite(relPath string, content []byte) {
+	sum := sha256.Sum256(content)
+	noteServerState(relPath, serverWrite{exists: true, hash: hex.EncodeToString(sum[:])})
+}
+
+// records that the server itself wrote a vault file whose content hash is already known
+func noteServerHash(relPath, hash string) {
+	noteServerState(relPath, serverWrite{exists: true, hash: hash})
+}
+
+// records that the server itself removed a vault file
+func noteServerRemove(relPath string) {
+	noteServerState(relPath, serverWrite{exists: false})
+}
+
+// records the removal of every file below a path (the path itself when it is a file)
+func noteServerRemoveTree(vaultPath, fullPath string) {
+	filepath.WalkDir(fullPath, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if relPath, err := filepath.Rel(vaultPath, path); err == nil {
+				noteServerRemove(relPath)
+			}
+		}
+		return nil
+	})
+}
+
+func noteServerState(relPath string, w serverWrite) {
+	w.at = time.Now()
+	serverWritesMutex.Lock()
+	serverWrites[filepath.ToSlash(filepath.Clean(relPath))] = w
+	serverWritesMutex.Unlock()
+}
+
+// reports whether the current state of a file is the one the server last wrote
+func isServerWrite(relPath string, exists bool, hash string) bool {
+	serverWritesMutex.Lock()
+	defer serverWritesMutex.Unlock()
+	for p, w := range serverWrites {
+		if time.Since(w.at) > serverWriteMemory {
+			delete(serverWrites, p)
+		}
+	}
+	w, ok := serverWrites[relPath]
+	return ok && w.exists == exists && (!exists || w.hash == hash)
+}
+
+// Watcher picks up files changed in the vault by anything other than the server
+// (scripts, imports, a shell), commits them and reports them so clients can be told.
+type Watcher struct {
+	vaultPath string
+	debounce  time.Duration
+	onChange  func(hash string, changes []PathChange)
+	fsWatcher *fsnotify.Watcher
+	pending   map[string]bool
+}
+
+// creates a watcher; onChange receives the commit holding the external changes
+func NewWatcher(vaultPath string, debounce time.Duration, onChange func(hash string, changes []PathChange)) (*Watcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		vaultPath: vaultPath,
+		debounce:  debounce,
+		onChange:  onChange,
+		fsWatcher: fsWatcher,
+		pending:   make(map[string]bool),
+	}
+	if err := w.watchTree(vaultPath, false); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// starts processing file system events in the background
+func (w *Watcher) Start() {
+	slog.Info("watch-goroutine: started", "vault path", w.vaultPath, "debounce", w.debounce)
+	go w.run()
+}
+
+// reports whether a vault-relative path is never watched (git, trash, staging, server state)
+func isUnwatchedPath(relPath string) bool {
+	return isReservedPath(relPath) || isInternalPath(relPath)
+}
+
+// adds watches for a directory and its subdirectories; with markFiles the files found are
+// queued as changes (they were created before the watch existed)
+func (w *Watcher) watchTree(root string, markFiles bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // vanished while walking
+		}
+		relPath, _ := filepath.Rel(w.vaultPath, path)
+		relPath = filepath.ToSlash(relPath)
+		if relPath != "." && isUnwatchedPath(relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return w.fsWatcher.Add(path)
+		}
+		if markFiles {
+			w.pending[relPath] = true
+		}
+		return nil
+	})
+}
+
+func (w *Watcher) run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.fsWatcher.Events:
+			if !ok {
+				return
+			}
+			relPath, err := filepath.Rel(w.vaultPath, event.Name)
+			if err != nil {
+				continue
+			}
+			relPath = filepath.ToSlash(relPath)
+			if relPath == "." || isUnwatchedPath(relPath) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := w.watchTree(event.Name, true); err != nil {
+						slog.Warn("watch-goroutine: could not watch directory", "path", relPath, "error", err)
+					}
+					timer.Reset(w.debounce)
+					continue
+				}
+			}
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				// a directory moved out of the vault reports no events for the files inside,
+				// flush expands a missing path to the files HEAD has below it
+				w.fsWatcher.Remove(event.Name)
+			}
+			w.pending[relPath] = true
+			timer.Reset(w.debounce)
+		case err, ok := <-w.fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("watch-goroutine: watcher error", "error", err)
+		case <-timer.C:
+			paths := w.pending
+			w.pending = make(map[string]bool)
+			w.flush(paths)
+		}
+	}
+}
+
+// commits the external changes among paths and reports them
+func (w *Watcher) flush(paths map[string]bool) {
+	state.FileSystemMutex.Lock()
+	repo, err := OpenRepo(w.vaultPath)
+	if err != nil {
+		state.FileSystemMutex.Unlock()
+		slog.Error("watch-goroutine: could not open repository", "error", err)
+		return
+	}
+	head, _ := repo.Head()
+	if head != "" {
+		for relPath := range paths {
+			if _, err := os.Lstat(filepath.Join(w.vaultPath, filepath.FromSlash(relPath))); !os.IsNotExist(err) {
+				continue
+			}
+			files, _ := repo.ListFiles(head, relPath)
+			for _, file := range files {
+				paths[file] = true
+			}
+		}
+	}
+	var changes []PathChange
+	var changedPaths []string
+	for relPath := range paths {
+		if change, ok := w.externalChange(repo, head, relPath); ok {
+			changes = append(changes, change)
+			changedPaths = append(changedPaths, change.Path)
+		}
+	}
+	if len(changes) == 0 {
+		state.FileSystemMutex.Unlock()
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	// only the external changes, pushes still waiting in the committer keep their own commit
+	hash, err := repo.CommitPaths(changedPaths, "External changes on the server", nil)
+	state.FileSystemMutex.Unlock()
+	if err != nil {
+		slog.Error("watch-goroutine: failed to commit external changes", "error", err)
+		return
+	}
+	slog.Info("watch-goroutine: external changes committed", "hash", hash, "files", len(changes))
+	if w.onChange != nil {
+		w.onChange(hash, changes)
+	}
+}
+
+// classifies the current state of a path, ok is false for the server's own writes and no-op events
+func (w *Watcher) externalChange(repo Repo, head, relPath string) (PathChange, bool) {
+	info, err := os.Stat(filepath.Join(w.vaultPath, filepath.FromSlash(relPath)))
+	if err == nil && info.IsDir() {
+		return PathChange{}, false
+	}
+	exists := err == nil
+	var content []byte
+	var hash string
+	if exists {
+		if content, err = os.ReadFile(filepath.Join(w.vaultPath, filepath.FromSlash(relPath))); err != nil {
+			return PathChange{}, false
+		}
+		sum := sha256.Sum256(content)
+		hash = hex.EncodeToString(sum[:])
+	}
+	if isServerWrite(relPath, exists, hash) {
+		return PathChange{}, false
+	}
+
+	var committed []byte
+	inHead := false
+	if head != "" {
+		committed, inHead, _ = repo.ReadFile(head, relPath)
+	}
+	switch {
+	case !exists && !inHead:
+		return PathChange{}, false // created and removed again
+	case !exists:
+		return PathChange{Path: relPath, Action: ChangeDeleted}, true
+	case !inHead:
+		return PathChange{Path: relPath, Action: ChangeAdded}, true
+	case string(committed) == string(content):
+		return PathChange{}, false // touched, not changed
+	default:
+		return PathChange{Path: relPath, Action: ChangeModified}, true
+	}
+}
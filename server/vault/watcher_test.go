@@ -0,0 +1,86 @@
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWatcherCommitsExternalChanges(t *testing.T) {
+	vaultPath, repo := newTestVault(t)
+	writeTestFile(t, vaultPath, "edited.md", "before")
+	writeTestFile(t, vaultPath, "moved/a.md", "a")
+	writeTestFile(t, vaultPath, "moved/sub/b.md", "b")
+	commitFile(t, vaultPath, repo, "touched.md", "same")
+
+	type report struct {
+		hash    string
+		changes []PathChange
+	}
+	reports := make(chan report, 10)
+	watcher, err := NewWatcher(vaultPath, 100*time.Millisecond, func(hash string, changes []PathChange) {
+		reports <- report{hash, changes}
+	})
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	t.Cleanup(func() { watcher.fsWatcher.Close() })
+	watcher.Start()
+
+	writeTestFile(t, vaultPath, "edited.md", "after")
+	writeTestFile(t, vaultPath, "touched.md", "same")
+	writeTestFile(t, vaultPath, "created/deep/new.md", "new") // a new directory, its file arrives with it
+	if err := os.Rename(filepath.Join(vaultPath, "moved"), filepath.Join(t.TempDir(), "moved")); err != nil {
+		t.Fatal(err)
+	}
+	// the server's own writes and its directories are not external changes
+	if err := WriteFile(vaultPath, "pushed.md", []byte("from a device")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, vaultPath, TrashDir+"/1/content", "deleted")
+
+	want := map[string]ChangeAction{
+		"edited.md":           ChangeModified,
+		"created/deep/new.md": ChangeAdded,
+		"moved/a.md":          ChangeDeleted,
+		"moved/sub/b.md":      ChangeDeleted,
+	}
+	got := make(map[string]ChangeAction)
+	var lastHash string
+	deadline := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case r := <-reports:
+			lastHash = r.hash
+			for _, change := range r.changes {
+				got[change.Path] = change.Action
+			}
+		case <-deadline:
+			t.Fatalf("changes reported = %v, want %v", got, want)
+		}
+	}
+	select {
+	case r := <-reports:
+		t.Errorf("unexpected changes reported: %+v", r.changes)
+	case <-time.After(300 * time.Millisecond):
+	}
+	for relPath, action := range want {
+		if got[relPath] != action {
+			t.Errorf("%s: %q, want %q", relPath, got[relPath], action)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("changes reported = %v, want %v", got, want)
+	}
+
+	files, err := repo.ListFiles(lastHash, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pushed.md is left to the committer, which commits it under the device that pushed it
+	if wantFiles := []string{"created/deep/new.md", "edited.md", "touched.md"}; !slices.Equal(files, wantFiles) {
+		t.Errorf("committed files = %v, want %v", files, wantFiles)
+	}
+}